@@ -60,3 +60,27 @@ Create the name of the service account to use
 {{- default "default" .Values.serviceAccount.name }}
 {{- end }}
 {{- end }}
+
+{{/*
+The label selector string of --namespace-selector converted from watchNamespaceSelector
+*/}}
+{{- define "gcp-workload-identity-federation-webhook.namespaceSelector" -}}
+{{- $requirements := list }}
+{{- range $key, $value := .Values.watchNamespaceSelector.matchLabels }}
+{{- $requirements = append $requirements (printf "%s=%s" $key $value) }}
+{{- end }}
+{{- range .Values.watchNamespaceSelector.matchExpressions }}
+{{- if eq .operator "In" }}
+{{- $requirements = append $requirements (printf "%s in (%s)" .key (join "," .values)) }}
+{{- else if eq .operator "NotIn" }}
+{{- $requirements = append $requirements (printf "%s notin (%s)" .key (join "," .values)) }}
+{{- else if eq .operator "Exists" }}
+{{- $requirements = append $requirements .key }}
+{{- else if eq .operator "DoesNotExist" }}
+{{- $requirements = append $requirements (printf "!%s" .key) }}
+{{- else }}
+{{- fail (printf "unknown operator %q in watchNamespaceSelector" .operator) }}
+{{- end }}
+{{- end }}
+{{- join "," $requirements }}
+{{- end }}
@@ -17,11 +17,17 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"flag"
+	"fmt"
+	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -30,11 +36,16 @@ import (
 	"github.com/pfnet-research/gcp-workload-identity-federation-webhook/webhooks"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	cliflag "k8s.io/component-base/cli/flag"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
@@ -54,6 +65,20 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bootstrap":
+			runBootstrap(os.Args[2:])
+			return
+		case "metadata-server":
+			runMetadataServer(os.Args[2:])
+			return
+		case "access-token-refresher":
+			runAccessTokenRefresher(os.Args[2:])
+			return
+		}
+	}
+
 	ctx := ctrl.SetupSignalHandler()
 
 	metricsAddr := flag.String("metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
@@ -61,13 +86,51 @@ func main() {
 	annotationPrefix := flag.String("annotation-prefix", webhooks.AnnotationDomainDefault, "The Service Account annotation to look for")
 	defaultAudience := flag.String("token-audience", webhooks.AudienceDefault, "The default audience for tokens. Can be overridden by annotation")
 	defaultTokenExpiration := flag.Duration("token-expiration", webhooks.DefaultTokenExpirationDefault, "The token expiration")
+	minTokenExpiration := flag.Duration("min-token-expiration", webhooks.MinTokenExprationDefault, "The minimum token expiration. Shorter ones in annotations are raised to this with a warning")
+	maxTokenExpiration := flag.Duration("max-token-expiration", 0, "If set, the maximum token expiration. Longer ones in annotations are lowered to this with a warning. Set it to the kube-apiserver's --service-account-max-token-expiration if configured")
+	podOverridableAnnotations := flag.String("pod-overridable-annotations", webhooks.TokenExpirationAnnotation, "Comma-separated list of annotations which Pods may set to override the ServiceAccount ones. Values: "+strings.Join(webhooks.PodOverridableAnnotations, ", "))
+	defaultInjectionMode := flag.String("default-injection-mode", string(webhooks.GCloudMode), "The injection mode for ServiceAccounts without the injection-mode annotation. Values: "+joinValues(webhooks.InjectionModes))
+	deprecatedInjectionModes := flag.String("deprecated-injection-modes", "", "Comma-separated list of injection modes which are warned about on Pod creation")
+	conflictPolicy := flag.String("conflict-policy", string(webhooks.ConflictPolicyReplace), "What to do when a Pod already has a different volume, volumeMount or init container colliding with the injected one by name or mount path. Values: "+joinValues(webhooks.ConflictPolicies))
 	defaultRegion := flag.String("gcp-default-region", "", "If set, CLOUDSDK_COMPUTE_REGION will be set to this value in mutated containers")
 	gCloudImage := flag.String("gcloud-image", webhooks.GcloudImageDefault, "Container image for the init container setting up GCloud SDK")
 	tokenDefaultMode := flag.Int("token-default-mode", webhooks.VolumeModeDefault, "DefaultMode for the token volume. CAUTION: if you allow reading from others (e.g. '0444'), the token can read from anyone who can log in to the node.")
+	bootstrapImage := flag.String("bootstrap-image", "", "If set, the init container setting up GCloud SDK runs the built-in 'bootstrap' subcommand of this image (i.e. this webhook's image) instead of using --gcloud-image")
+	sidecarImage := flag.String("sidecar-image", "", "Container image (i.e. this webhook's image) for the injected sidecars. 'metadata' and 'access-token' injection modes are enabled only when set")
+	accessTokenRefreshMargin := flag.Duration("access-token-refresh-margin", 0, "How long before expiry the access token sidecar refreshes the token in 'access-token' injection mode (default "+webhooks.AccessTokenRefreshMarginDefault.String()+")")
+	accessTokenRetryInitialBackoff := flag.Duration("access-token-retry-initial-backoff", 0, "The initial retry backoff of the access token sidecar in 'access-token' injection mode (default "+webhooks.AccessTokenRetryInitialBackoffDefault.String()+")")
+	accessTokenRetryMaxBackoff := flag.Duration("access-token-retry-max-backoff", 0, "The maximum retry backoff of the access token sidecar in 'access-token' injection mode (default "+webhooks.AccessTokenRetryMaxBackoffDefault.String()+")")
+	gCloudImagePullSecrets := flag.String("gcloud-image-pull-secrets", "", "Comma-separated list of image pull secret names added to mutated Pods when the init container setting up GCloud SDK is injected")
+	syncGCloudImagePullSecrets := flag.Bool("sync-gcloud-image-pull-secrets", false, "If set, the secrets in --gcloud-image-pull-secrets are copied from --gcloud-image-pull-secrets-namespace into all other namespaces")
+	gCloudImagePullSecretsNamespace := flag.String("gcloud-image-pull-secrets-namespace", os.Getenv("POD_NAMESPACE"), "The namespace holding the source secrets for --sync-gcloud-image-pull-secrets. Defaults to $POD_NAMESPACE")
+	skipPodLabel := flag.String("skip-pod-label", webhooks.SkipPodLabelDefault, "Pods with this label set to 'true' are not mutated. Set the same label in the objectSelector of the webhook configuration to skip calling the webhook. Disabled if empty")
+	serviceAccountLookupTimeout := flag.Duration("serviceaccount-lookup-timeout", webhooks.ServiceAccountLookupTimeoutDefault, "The timeout to look up a ServiceAccount from the API server when it is not found in the cache")
+	serviceAccountLabelSelector := flag.String("serviceaccount-label-selector", "", "Label selector of the ServiceAccounts to cache and inject identities for, e.g. 'gcp-workload-identity=enabled'. Pods of other ServiceAccounts are not mutated. All ServiceAccounts if empty")
+	serviceAccountNamespaces := flag.String("serviceaccount-namespaces", "", "Comma-separated list of namespaces of the ServiceAccounts to cache and inject identities for. Pods in other namespaces are not mutated. All namespaces if empty")
+	namespaces := flag.String("namespaces", "", "Comma-separated list of namespaces the webhook serves. Only the objects in them are cached, so that the webhook runs with namespace-scoped RBAC. All namespaces if empty")
+	namespaceSelector := flag.String("namespace-selector", "", "Label selector of the namespaces the webhook serves, e.g. 'tenant=a'. It requires the permission to watch Namespaces. All namespaces if empty")
+	podSecurityStandards := flag.Bool("pod-security-standards", false, "If set, the injected container is shaped for the restricted Pod Security Standards in the namespaces enforcing it by the pod-security.kubernetes.io/enforce label, and the Pods whose injected container still violates it are rejected. It requires the permission to watch Namespaces")
+	rejectMissingServiceAccount := flag.Bool("reject-missing-serviceaccount", false, "If set, Pods whose ServiceAccount is not found are rejected instead of admitted without mutation")
+	workloadPreview := flag.Bool("workload-preview", false, "If set, the webhook serves /mutate-workloads which annotates Deployments, StatefulSets, DaemonSets, Jobs and CronJobs with the preview of the identity injected into their Pods")
+	selfManagedCert := flag.Bool("self-managed-cert", false, "If set, the webhook generates and rotates its serving certificate and CA in --self-managed-cert-secret and injects the CA into --mutating-webhook-configuration, instead of loading the certificate from files (e.g. issued by cert-manager)")
+	selfManagedCertSecret := flag.String("self-managed-cert-secret", "webhook-server-cert", "The name of the Secret in $POD_NAMESPACE storing the self-managed certificate")
+	selfManagedCertDNSNames := flag.String("self-managed-cert-dns-names", "", "Comma-separated list of DNS names of the self-managed certificate, i.e. the names of the webhook Service")
+	selfManagedCertValidity := flag.Duration("self-managed-cert-validity", webhooks.SelfManagedCertValidityDefault, "The validity of the self-managed serving certificate. It is rotated when less than 1/3 of the validity remains. The CA is valid 10 times longer")
+	certDir := flag.String("cert-dir", filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs"), "The directory containing the serving certificate and key files. They are reloaded on change, e.g. when rotated by a CSI driver or Vault agent")
+	certName := flag.String("cert-name", "tls.crt", "The serving certificate file name in --cert-dir")
+	keyName := flag.String("key-name", "tls.key", "The serving key file name in --cert-dir")
+	mutatingWebhookConfiguration := flag.String("mutating-webhook-configuration", "", "The name of the MutatingWebhookConfiguration to inject the CA of the self-managed certificate into")
 	setupContainerResources := flag.String("setup-container-resources", webhooks.SetupContainerResources, `Resource spec in json for the init container setting up GCloud SDK, e.g. '{"requests":{"cpu":"100m"}}'`)
+	auditLogPath := flag.String("audit-log-path", "", "If set, the webhook writes a JSON line per admission request of Pods to this file ('-' means stdout), separately from the debug log")
+	auditLogSampleRate := flag.Float64("audit-log-sample-rate", 1, "Fraction (0-1) of the audit records of the Pods not mutated to write. The records of the mutated, denied and errored Pods are always written")
+	auditLogRedactFields := flag.String("audit-log-redact-fields", "", "Comma-separated list of the audit record fields to redact. Values: "+strings.Join(webhooks.AuditFields, ", "))
+	tracingEndpoint := flag.String("tracing-endpoint", "", "If set, the webhook exports OpenTelemetry traces of the admission requests to this OTLP/HTTP endpoint, e.g. 'http://otel-collector:4318'")
+	tracingSampleRatio := flag.Float64("tracing-sample-ratio", 1, "Fraction (0-1) of the admission requests to trace. The sampling decision of the kube-apiserver is respected if it propagates the trace context")
 	tlsCipherSuiteValues := cliflag.PreferredTLSCipherNames()
 	tlsCipherSuiteInsecureValues := cliflag.InsecureTLSCipherNames()
 	tlsCipherSuites := flag.String("tls-cipher-suites", "", "Comma-separated list of TLS cipher suites to be used by the webhook server. \nValues: "+strings.Join(tlsCipherSuiteValues, ", ")+"\nInsecure Values: "+strings.Join(tlsCipherSuiteInsecureValues, ", "))
+	clientCAFile := flag.String("client-ca-file", "", "If set, the webhook server requires the clients, i.e. the kube-apiserver, to present a certificate signed by the CA in this file. Configure the kube-apiserver's client certificate for the webhook with --admission-control-config-file")
+	clientCertNames := flag.String("client-cert-names", "", "Comma-separated list of the common names or DNS names allowed for the client certificates verified by --client-ca-file. All names if empty")
 	tlsMinVersionValues := cliflag.TLSPossibleVersions()
 	tlsMinVersion := flag.String("tls-min-version", "", "The minimum TLS version to be used by the webhook server. ("+strings.Join(tlsMinVersionValues, ", ")+")")
 
@@ -88,6 +151,157 @@ func main() {
 		}
 	}
 
+	// the kube-apiserver requires at least 10 minutes for projected ServiceAccount tokens
+	if *minTokenExpiration < 10*time.Minute {
+		setupLog.Error(fmt.Errorf("%s is shorter than 10m", *minTokenExpiration), "unable to parse the value of --min-token-expiration")
+		os.Exit(1)
+	}
+	if *maxTokenExpiration != 0 && *maxTokenExpiration < *minTokenExpiration {
+		setupLog.Error(fmt.Errorf("%s is shorter than --min-token-expiration", *maxTokenExpiration), "unable to parse the value of --max-token-expiration")
+		os.Exit(1)
+	}
+	if *defaultTokenExpiration < *minTokenExpiration || (*maxTokenExpiration != 0 && *defaultTokenExpiration > *maxTokenExpiration) {
+		setupLog.Error(fmt.Errorf("%s is out of --min-token-expiration and --max-token-expiration", *defaultTokenExpiration), "unable to parse the value of --token-expiration")
+		os.Exit(1)
+	}
+
+	// empty but not nil to allow no annotations
+	podOverridableAnnotationNames := []string{}
+	for _, name := range strings.Split(*podOverridableAnnotations, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if !slices.Contains(webhooks.PodOverridableAnnotations, name) {
+			setupLog.Error(fmt.Errorf("%s is not overridable by Pods", name), "unable to parse the value of --pod-overridable-annotations")
+			os.Exit(1)
+		}
+		podOverridableAnnotationNames = append(podOverridableAnnotationNames, name)
+	}
+
+	if !slices.Contains(webhooks.InjectionModes, webhooks.InjectionMode(*defaultInjectionMode)) {
+		setupLog.Error(fmt.Errorf("unknown injection mode %q", *defaultInjectionMode), "unable to parse the value of --default-injection-mode")
+		os.Exit(1)
+	}
+	var deprecatedInjectionModeValues []webhooks.InjectionMode
+	for _, mode := range strings.Split(*deprecatedInjectionModes, ",") {
+		if mode = strings.TrimSpace(mode); mode == "" {
+			continue
+		}
+		if !slices.Contains(webhooks.InjectionModes, webhooks.InjectionMode(mode)) {
+			setupLog.Error(fmt.Errorf("unknown injection mode %q", mode), "unable to parse the value of --deprecated-injection-modes")
+			os.Exit(1)
+		}
+		deprecatedInjectionModeValues = append(deprecatedInjectionModeValues, webhooks.InjectionMode(mode))
+	}
+
+	if !slices.Contains(webhooks.ConflictPolicies, webhooks.ConflictPolicy(*conflictPolicy)) {
+		setupLog.Error(fmt.Errorf("unknown conflict policy %q", *conflictPolicy), "unable to parse the value of --conflict-policy")
+		os.Exit(1)
+	}
+
+	var serviceAccountSelector labels.Selector
+	if *serviceAccountLabelSelector != "" {
+		selector, err := labels.Parse(*serviceAccountLabelSelector)
+		if err != nil {
+			setupLog.Error(err, "unable to parse the value of --serviceaccount-label-selector")
+			os.Exit(1)
+		}
+		serviceAccountSelector = selector
+	}
+	var namespaceNames []string
+	defaultNamespaces := map[string]cache.Config{}
+	for _, ns := range strings.Split(*namespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			namespaceNames = append(namespaceNames, ns)
+			defaultNamespaces[ns] = cache.Config{}
+		}
+	}
+	var serviceAccountNamespaceNames []string
+	for _, ns := range strings.Split(*serviceAccountNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns == "" {
+			continue
+		}
+		if len(namespaceNames) > 0 && !slices.Contains(namespaceNames, ns) {
+			setupLog.Error(fmt.Errorf("%s is not in --namespaces", ns), "unable to parse the value of --serviceaccount-namespaces")
+			os.Exit(1)
+		}
+		serviceAccountNamespaceNames = append(serviceAccountNamespaceNames, ns)
+	}
+	if len(serviceAccountNamespaceNames) == 0 {
+		serviceAccountNamespaceNames = namespaceNames
+	}
+	serviceAccountObject, serviceAccountByObject := webhooks.ServiceAccountCacheByObject(serviceAccountSelector, serviceAccountNamespaceNames)
+
+	var namespaceLabelSelector labels.Selector
+	if *namespaceSelector != "" {
+		selector, err := labels.Parse(*namespaceSelector)
+		if err != nil {
+			setupLog.Error(err, "unable to parse the value of --namespace-selector")
+			os.Exit(1)
+		}
+		namespaceLabelSelector = selector
+	}
+
+	var auditLogger *webhooks.AuditLogger
+	if *auditLogPath != "" {
+		if *auditLogSampleRate < 0 || *auditLogSampleRate > 1 {
+			setupLog.Error(fmt.Errorf("%v is out of 0-1", *auditLogSampleRate), "unable to parse the value of --audit-log-sample-rate")
+			os.Exit(1)
+		}
+		var redactFields []string
+		for _, f := range strings.Split(*auditLogRedactFields, ",") {
+			if f = strings.TrimSpace(f); f == "" {
+				continue
+			}
+			if !slices.Contains(webhooks.AuditFields, f) {
+				setupLog.Error(fmt.Errorf("unknown audit field %q", f), "unable to parse the value of --audit-log-redact-fields")
+				os.Exit(1)
+			}
+			redactFields = append(redactFields, f)
+		}
+		w := os.Stdout
+		if *auditLogPath != "-" {
+			f, err := os.OpenFile(*auditLogPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+			if err != nil {
+				setupLog.Error(err, "unable to open the audit log")
+				os.Exit(1)
+			}
+			defer f.Close()
+			w = f
+		}
+		auditLogger = &webhooks.AuditLogger{Writer: w, SampleRate: *auditLogSampleRate, RedactFields: redactFields}
+	}
+
+	shutdownTracing, err := webhooks.SetupTracing(ctx, webhooks.TracingOptions{Endpoint: *tracingEndpoint, SampleRatio: *tracingSampleRatio})
+	if err != nil {
+		setupLog.Error(err, "unable to set up tracing")
+		os.Exit(1)
+	}
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			setupLog.Error(err, "unable to flush the traces")
+		}
+	}()
+
+	var gCloudImagePullSecretRefs []corev1.LocalObjectReference
+	var gCloudImagePullSecretNames []string
+	for _, name := range strings.Split(*gCloudImagePullSecrets, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			gCloudImagePullSecretRefs = append(gCloudImagePullSecretRefs, corev1.LocalObjectReference{Name: name})
+			gCloudImagePullSecretNames = append(gCloudImagePullSecretNames, name)
+		}
+	}
+
+	cacheByObject := map[client.Object]cache.ByObject{
+		serviceAccountObject: serviceAccountByObject,
+	}
+	if *syncGCloudImagePullSecrets && len(gCloudImagePullSecretNames) > 0 {
+		secretObject, secretByObject := webhooks.ImagePullSecretCacheByObject(*gCloudImagePullSecretsNamespace, namespaceNames)
+		cacheByObject[secretObject] = secretByObject
+	}
+
 	var tlsOpts []func(*tls.Config)
 
 	if *tlsCipherSuites != "" {
@@ -114,8 +328,68 @@ func main() {
 		})
 	}
 
+	if *clientCAFile != "" {
+		var names []string
+		for _, name := range strings.Split(*clientCertNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		clientCertVerification, err := webhooks.ClientCertVerification(*clientCAFile, names)
+		if err != nil {
+			setupLog.Error(err, "unable to parse the value of --client-ca-file")
+			os.Exit(1)
+		}
+		tlsOpts = append(tlsOpts, clientCertVerification)
+	}
+
+	var certs *webhooks.SelfManagedCert
+	if *selfManagedCert {
+		var dnsNames []string
+		for _, name := range strings.Split(*selfManagedCertDNSNames, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				dnsNames = append(dnsNames, name)
+			}
+		}
+		if len(dnsNames) == 0 {
+			setupLog.Error(fmt.Errorf("no DNS names"), "unable to parse the value of --self-managed-cert-dns-names")
+			os.Exit(1)
+		}
+		if *mutatingWebhookConfiguration == "" {
+			setupLog.Error(fmt.Errorf("empty name"), "unable to parse the value of --mutating-webhook-configuration")
+			os.Exit(1)
+		}
+		certs = &webhooks.SelfManagedCert{
+			Secret:                   types.NamespacedName{Namespace: os.Getenv("POD_NAMESPACE"), Name: *selfManagedCertSecret},
+			DNSNames:                 dnsNames,
+			WebhookConfigurationName: *mutatingWebhookConfiguration,
+			Validity:                 *selfManagedCertValidity,
+			OnLoad:                   webhooks.ServingCertificateObserver(ctrl.Log.WithName("self-managed-cert")),
+		}
+		tlsOpts = append(tlsOpts, func(c *tls.Config) {
+			c.GetCertificate = certs.GetCertificate
+		})
+	}
+
+	var certWatcher *certwatcher.CertWatcher
+	if certs == nil {
+		var err error
+		certWatcher, err = certwatcher.New(filepath.Join(*certDir, *certName), filepath.Join(*certDir, *keyName))
+		if err != nil {
+			setupLog.Error(err, "unable to load the serving certificate")
+			os.Exit(1)
+		}
+		certWatcher.RegisterCallback(webhooks.ServingCertificateObserver(ctrl.Log.WithName("cert-watcher")))
+		tlsOpts = append(tlsOpts, func(c *tls.Config) {
+			c.GetCertificate = certWatcher.GetCertificate
+		})
+	}
+
 	webhookOptions := webhook.Options{
-		TLSOpts: tlsOpts,
+		CertDir:  *certDir,
+		CertName: *certName,
+		KeyName:  *keyName,
+		TLSOpts:  tlsOpts,
 	}
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
@@ -125,32 +399,96 @@ func main() {
 		},
 		HealthProbeBindAddress: *probeAddr,
 		WebhookServer:          webhook.NewServer(webhookOptions),
+		Cache: cache.Options{
+			DefaultNamespaces: defaultNamespaces,
+			ByObject:          cacheByObject,
+		},
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
 
-	if err := (&webhooks.GCPWorkloadIdentityMutator{
-		AnnotationDomain:        *annotationPrefix,
-		DefaultAudience:         *defaultAudience,
-		DefaultTokenExpiration:  *defaultTokenExpiration,
-		MinTokenExpration:       webhooks.MinTokenExprationDefault,
-		DefaultGCloudRegion:     *defaultRegion,
-		GcloudImage:             *gCloudImage,
-		DefaultMode:             int32(*tokenDefaultMode),
-		SetupContainerResources: setupContainerResourceRequirements,
-	}).SetupWithManager(ctx, mgr); err != nil {
+	if certs != nil {
+		if err := certs.SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to setup self-managed-cert")
+			os.Exit(1)
+		}
+	}
+	if certWatcher != nil {
+		if err := mgr.Add(certWatcher); err != nil {
+			setupLog.Error(err, "unable to setup cert-watcher")
+			os.Exit(1)
+		}
+	}
+
+	mutator := &webhooks.GCPWorkloadIdentityMutator{
+		AnnotationDomain:          *annotationPrefix,
+		DefaultAudience:           *defaultAudience,
+		DefaultTokenExpiration:    *defaultTokenExpiration,
+		MinTokenExpration:         *minTokenExpiration,
+		MaxTokenExpiration:        *maxTokenExpiration,
+		PodOverridableAnnotations: podOverridableAnnotationNames,
+		DefaultInjectionMode:      webhooks.InjectionMode(*defaultInjectionMode),
+		DeprecatedInjectionModes:  deprecatedInjectionModeValues,
+		DefaultGCloudRegion:       *defaultRegion,
+		GcloudImage:               *gCloudImage,
+		BootstrapImage:            *bootstrapImage,
+		SidecarImage:              *sidecarImage,
+		AccessTokenRefresher: webhooks.AccessTokenRefresherOptions{
+			RefreshMargin:       *accessTokenRefreshMargin,
+			RetryInitialBackoff: *accessTokenRetryInitialBackoff,
+			RetryMaxBackoff:     *accessTokenRetryMaxBackoff,
+		},
+		DefaultMode:                 int32(*tokenDefaultMode),
+		SetupContainerResources:     setupContainerResourceRequirements,
+		GcloudImagePullSecrets:      gCloudImagePullSecretRefs,
+		ConflictPolicy:              webhooks.ConflictPolicy(*conflictPolicy),
+		SkipPodLabel:                *skipPodLabel,
+		ServiceAccountLookupTimeout: *serviceAccountLookupTimeout,
+		RejectMissingServiceAccount: *rejectMissingServiceAccount,
+		ServiceAccountSelector:      serviceAccountSelector,
+		ServiceAccountNamespaces:    serviceAccountNamespaceNames,
+		NamespaceSelector:           namespaceLabelSelector,
+		PodSecurityStandards:        *podSecurityStandards,
+		AuditLogger:                 auditLogger,
+	}
+	if err := mutator.SetupWithManager(ctx, mgr); err != nil {
 		setupLog.Error(err, "unable to setup gcp-workload-identity-mutator")
 		os.Exit(1)
 	}
+	if *workloadPreview {
+		if err := (&webhooks.WorkloadPreviewAnnotator{
+			Mutator: mutator,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to setup workload-preview-annotator")
+			os.Exit(1)
+		}
+	}
+	if *syncGCloudImagePullSecrets && len(gCloudImagePullSecretNames) > 0 {
+		if err := (&webhooks.ImagePullSecretSyncer{
+			SourceNamespace:  *gCloudImagePullSecretsNamespace,
+			SecretNames:      gCloudImagePullSecretNames,
+			TargetNamespaces: namespaceNames,
+			AnnotationDomain: *annotationPrefix,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to setup image-pull-secret-syncer")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
-	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
+	// replicas become ready after the ServiceAccounts are cached and the serving certificate is loaded,
+	// so that rolling updates never send admission requests to replicas unable to handle them
+	if err := mgr.AddReadyzCheck("cache", webhooks.CacheSyncedChecker(mgr.GetCache())); err != nil {
+		setupLog.Error(err, "unable to set up ready check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("webhook", mgr.GetWebhookServer().StartedChecker()); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
@@ -161,3 +499,139 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func joinValues[T ~string](values []T) string {
+	s := make([]string, len(values))
+	for i := range values {
+		s[i] = string(values[i])
+	}
+	return strings.Join(s, ", ")
+}
+
+// runBootstrap runs the 'bootstrap' subcommand which writes the external account credentials
+// and a minimal gcloud configuration in the init container injected by the webhook.
+func runBootstrap(args []string) {
+	fs := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	c := webhooks.GCloudBootstrapConfig{}
+	fs.StringVar(&c.WorkloadIdentityProvider, "workload-identity-provider", "", "The workload identity provider resource name")
+	fs.StringVar(&c.ServiceAccountEmail, "service-account", "", "The GCP service account email to impersonate")
+	fs.StringVar(&c.ConfigDir, "config-dir", os.Getenv("CLOUDSDK_CONFIG"), "The gcloud configuration directory to write. Defaults to $CLOUDSDK_CONFIG")
+	fs.StringVar(&c.CredentialSourceFile, "credential-source-file", "", "The path to the Kubernetes ServiceAccount token")
+	fs.StringVar(&c.Project, "project", "", "The default GCP project")
+	fs.StringVar(&c.Region, "region", "", "The default GCP compute region")
+	_ = fs.Parse(args)
+
+	if err := c.Write(); err != nil {
+		fmt.Fprintf(os.Stderr, "bootstrap failed: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runMetadataServer runs the 'metadata-server' subcommand which serves the GCE metadata server emulation
+// in the sidecar injected by the webhook in 'metadata' injection mode.
+func runMetadataServer(args []string) {
+	fs := flag.NewFlagSet("metadata-server", flag.ExitOnError)
+	workloadIdentityProvider := fs.String("workload-identity-provider", "", "The workload identity provider resource name")
+	serviceAccount := fs.String("service-account", "", "The GCP service account email to impersonate")
+	credentialSourceFile := fs.String("credential-source-file", "", "The path to the Kubernetes ServiceAccount token")
+	project := fs.String("project", "", "The GCP project served as project/project-id")
+	listenAddress := fs.String("listen-address", webhooks.MetadataServerAddress, "The address the metadata server binds to")
+	check := fs.Bool("check", false, "Exit successfully if the metadata server at --listen-address responds, for startupProbe")
+	refreshMargin := fs.Duration("refresh-margin", 5*time.Minute, "Access tokens are refreshed this long before they expire")
+	opts := zap.Options{}
+	opts.BindFlags(fs)
+	_ = fs.Parse(args)
+
+	if *check {
+		resp, err := (&http.Client{Timeout: time.Second}).Get("http://" + *listenAddress + "/")
+		if err != nil {
+			os.Exit(1)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger := zap.New(zap.UseFlagOptions(&opts)).WithName("metadata-server")
+	if *workloadIdentityProvider == "" || *serviceAccount == "" || *credentialSourceFile == "" {
+		logger.Error(nil, "--workload-identity-provider, --service-account and --credential-source-file must be set")
+		os.Exit(1)
+	}
+
+	creds := webhooks.NewExternalAccountCredentials(fmt.Sprintf("//iam.googleapis.com/%s", *workloadIdentityProvider), *serviceAccount)
+	creds.CredentialSource.File = *credentialSourceFile
+	server := &http.Server{
+		Addr: *listenAddress,
+		Handler: &webhooks.MetadataServer{
+			TokenSource: &webhooks.CachingTokenSource{
+				Source:        &webhooks.ExternalAccountTokenSource{Credentials: creds},
+				RefreshMargin: *refreshMargin,
+			},
+			ServiceAccountEmail: *serviceAccount,
+			ProjectID:           *project,
+			Logger:              logger,
+		},
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+	go func() {
+		<-ctx.Done()
+		_ = server.Shutdown(context.Background())
+	}()
+
+	logger.Info("starting metadata server", "address", *listenAddress)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error(err, "problem running metadata server")
+		os.Exit(1)
+	}
+}
+
+// runAccessTokenRefresher runs the 'access-token-refresher' subcommand which keeps the access token file fresh
+// in the sidecar injected by the webhook in 'access-token' injection mode.
+func runAccessTokenRefresher(args []string) {
+	fs := flag.NewFlagSet("access-token-refresher", flag.ExitOnError)
+	workloadIdentityProvider := fs.String("workload-identity-provider", "", "The workload identity provider resource name")
+	serviceAccount := fs.String("service-account", "", "The GCP service account email to impersonate")
+	credentialSourceFile := fs.String("credential-source-file", "", "The path to the Kubernetes ServiceAccount token")
+	tokenFile := fs.String("token-file", "", "The path to write the access token to")
+	check := fs.Bool("check", false, "Exit successfully if the token file exists and is not empty, for startupProbe")
+	refreshMargin := fs.Duration("refresh-margin", webhooks.AccessTokenRefreshMarginDefault, "Access tokens are refreshed this long before they expire")
+	retryInitialBackoff := fs.Duration("retry-initial-backoff", webhooks.AccessTokenRetryInitialBackoffDefault, "The first retry backoff after a failure, doubled for each consecutive failure")
+	retryMaxBackoff := fs.Duration("retry-max-backoff", webhooks.AccessTokenRetryMaxBackoffDefault, "The maximum retry backoff")
+	opts := zap.Options{}
+	opts.BindFlags(fs)
+	_ = fs.Parse(args)
+
+	if *check {
+		if fi, err := os.Stat(*tokenFile); err != nil || fi.Size() == 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
+	logger := zap.New(zap.UseFlagOptions(&opts)).WithName("access-token-refresher")
+	if *workloadIdentityProvider == "" || *serviceAccount == "" || *credentialSourceFile == "" || *tokenFile == "" {
+		logger.Error(nil, "--workload-identity-provider, --service-account, --credential-source-file and --token-file must be set")
+		os.Exit(1)
+	}
+
+	creds := webhooks.NewExternalAccountCredentials(fmt.Sprintf("//iam.googleapis.com/%s", *workloadIdentityProvider), *serviceAccount)
+	creds.CredentialSource.File = *credentialSourceFile
+	refresher := &webhooks.AccessTokenRefresher{
+		TokenSource:         &webhooks.ExternalAccountTokenSource{Credentials: creds},
+		Path:                *tokenFile,
+		RefreshMargin:       *refreshMargin,
+		RetryInitialBackoff: *retryInitialBackoff,
+		RetryMaxBackoff:     *retryMaxBackoff,
+		Logger:              logger,
+	}
+
+	logger.Info("starting access token refresher", "tokenFile", *tokenFile)
+	if err := refresher.Run(ctrl.SetupSignalHandler()); err != nil && err != context.Canceled {
+		logger.Error(err, "problem running access token refresher")
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,120 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	AccessTokenRefreshMarginDefault       = 5 * time.Minute
+	AccessTokenRetryInitialBackoffDefault = time.Second
+	AccessTokenRetryMaxBackoffDefault     = time.Minute
+)
+
+// AccessTokenRefresherOptions are the options of the access token refresher sidecar injected by the webhook.
+// Zero values fall back to the sidecar's defaults.
+type AccessTokenRefresherOptions struct {
+	RefreshMargin       time.Duration
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+}
+
+func (o AccessTokenRefresherOptions) args() []string {
+	var args []string
+	if o.RefreshMargin > 0 {
+		args = append(args, "--refresh-margin="+o.RefreshMargin.String())
+	}
+	if o.RetryInitialBackoff > 0 {
+		args = append(args, "--retry-initial-backoff="+o.RetryInitialBackoff.String())
+	}
+	if o.RetryMaxBackoff > 0 {
+		args = append(args, "--retry-max-backoff="+o.RetryMaxBackoff.String())
+	}
+	return args
+}
+
+// AccessTokenRefresher keeps the access token file at Path fresh. The file is replaced atomically by rename,
+// so readers never see a partially written token.
+type AccessTokenRefresher struct {
+	TokenSource TokenSource
+	Path        string
+
+	// RefreshMargin is how long before its expiry the token is refreshed
+	RefreshMargin time.Duration
+	// RetryInitialBackoff is the first wait after a failure, doubled for each consecutive failure up to RetryMaxBackoff
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+
+	Logger logr.Logger
+}
+
+// Refresh acquires a token and writes it to the file
+func (r *AccessTokenRefresher) Refresh(ctx context.Context) (*AccessToken, error) {
+	token, err := r.TokenSource.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomically(r.Path, []byte(token.Token)); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// Run refreshes the token until ctx is done, retrying failures with exponential backoff.
+func (r *AccessTokenRefresher) Run(ctx context.Context) error {
+	backoff := r.RetryInitialBackoff
+	for {
+		var wait time.Duration
+		token, err := r.Refresh(ctx)
+		if err != nil {
+			r.Logger.Error(err, "Failed to refresh access token", "retryAfter", backoff)
+			wait = backoff
+			backoff = min(backoff*2, r.RetryMaxBackoff)
+		} else {
+			wait = time.Until(token.Expiry) - r.RefreshMargin
+			r.Logger.V(1).Info("Refreshed access token", "expiry", token.Expiry, "nextRefresh", wait)
+			backoff = r.RetryInitialBackoff
+			if wait < r.RetryInitialBackoff {
+				// the token lives shorter than the margin, avoid a busy loop
+				wait = r.RetryInitialBackoff
+			}
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func writeFileAtomically(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %w", err)
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("could not write temporary file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("could not close temporary file: %w", err)
+	}
+	// application containers may run as another user
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return fmt.Errorf("could not chmod temporary file: %w", err)
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("could not rename temporary file: %w", err)
+	}
+	return nil
+}
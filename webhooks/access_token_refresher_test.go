@@ -0,0 +1,89 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+func TestAccessTokenRefresher(t *testing.T) {
+	const saEmail = "sa@project.iam.gserviceaccount.com"
+
+	newRefresher := func(t *testing.T, sts *fakeSTS) *AccessTokenRefresher {
+		return &AccessTokenRefresher{
+			TokenSource:         &ExternalAccountTokenSource{Credentials: sts.credentials(t, saEmail)},
+			Path:                filepath.Join(t.TempDir(), AccessTokenFilename),
+			RefreshMargin:       AccessTokenRefreshMarginDefault,
+			RetryInitialBackoff: 10 * time.Millisecond,
+			RetryMaxBackoff:     40 * time.Millisecond,
+			Logger:              logr.Discard(),
+		}
+	}
+
+	t.Run("Refresh writes the token atomically", func(t *testing.T) {
+		r := newRefresher(t, newFakeSTS(t, "k8s-token"))
+		if _, err := r.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh() returned unexpected error: %v", err)
+		}
+
+		b, err := os.ReadFile(r.Path)
+		if err != nil {
+			t.Fatalf("token file is not written: %v", err)
+		}
+		if string(b) != "gsa-token" {
+			t.Errorf("token file = %q, want %q", b, "gsa-token")
+		}
+		entries, _ := os.ReadDir(filepath.Dir(r.Path))
+		if len(entries) != 1 {
+			t.Errorf("temporary files are left: %v", entries)
+		}
+	})
+
+	t.Run("Run retries failures with backoff", func(t *testing.T) {
+		sts := newFakeSTS(t, "k8s-token")
+		sts.failures.Store(3)
+		r := newRefresher(t, sts)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- r.Run(ctx) }()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := os.Stat(r.Path); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("token file is not written after retries")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run() = %v, want %v", err, context.Canceled)
+		}
+		if n := sts.exchanges.Load(); n != 1 {
+			t.Errorf("successful token exchanges = %d, want 1", n)
+		}
+	})
+
+	t.Run("Run refreshes before expiry", func(t *testing.T) {
+		sts := newFakeSTS(t, "k8s-token")
+		r := newRefresher(t, sts)
+		// every token is already within the margin
+		r.RefreshMargin = 2 * time.Hour
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		_ = r.Run(ctx)
+
+		if n := sts.exchanges.Load(); n < 2 {
+			t.Errorf("token exchanges = %d, want at least 2", n)
+		}
+	})
+}
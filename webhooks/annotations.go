@@ -36,11 +36,20 @@ const (
 	// Annotations for Pod
 	//
 	// The External Credentials JSON blob to be injected into the cluster, only used in 'direct' mode.
+	// The ones suffixed with ".{name}" are of the additional identities and used in any mode.
 	ExternalCredentialsJsonAnnotation = "external-credentials-json"
 
 	//
 	// Annotations for ServiceAccount
 	//
-	// Set to 'direct' or 'gcloud' to determine credential injection mode. Defaults to 'gcloud'.
+	// Set to 'direct', 'gcloud', 'metadata' or 'access-token' to determine credential injection mode. Defaults to 'gcloud'.
 	InjectionModeAnnotation = "injection-mode"
+
+	//
+	// Annotations for Deployment, StatefulSet, DaemonSet, Job and CronJob
+	//
+	// The preview of the identity injected into the Pods, set by WorkloadPreviewAnnotator.
+	PreviewWorkloadIdentityProviderAnnotation = "preview-workload-identity-provider"
+	PreviewServiceAccountEmailAnnotation      = "preview-service-account-email"
+	PreviewInjectionModeAnnotation            = "preview-injection-mode"
 )
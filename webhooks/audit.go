@@ -0,0 +1,159 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// AuditOutcome is the decision of the webhook for a Pod
+type AuditOutcome string
+
+const (
+	AuditOutcomeMutated AuditOutcome = "mutated"
+	AuditOutcomeSkipped AuditOutcome = "skipped"
+	AuditOutcomeDenied  AuditOutcome = "denied"
+	AuditOutcomeErrored AuditOutcome = "errored"
+
+	auditRedacted = "REDACTED"
+)
+
+// AuditRecord is the record of a Handle call of GCPWorkloadIdentityMutator
+type AuditRecord struct {
+	Time                     time.Time    `json:"time"`
+	UID                      types.UID    `json:"uid"`
+	Namespace                string       `json:"namespace"`
+	PodName                  string       `json:"podName,omitempty"`
+	PodGenerateName          string       `json:"podGenerateName,omitempty"`
+	ServiceAccount           string       `json:"serviceAccount,omitempty"`
+	WorkloadIdentityProvider string       `json:"workloadIdentityProvider,omitempty"`
+	ServiceAccountEmail      string       `json:"serviceAccountEmail,omitempty"`
+	Audience                 string       `json:"audience,omitempty"`
+	TokenExpirationSeconds   int64        `json:"tokenExpirationSeconds,omitempty"`
+	InjectionMode            string       `json:"injectionMode,omitempty"`
+	SkippedContainers        []string     `json:"skippedContainers,omitempty"`
+	Outcome                  AuditOutcome `json:"outcome"`
+	Reason                   string       `json:"reason,omitempty"`
+	PatchSize                int          `json:"patchSize"`
+
+	// implicitInjectionMode is not logged but labels the metrics of the mutated Pods
+	implicitInjectionMode bool
+}
+
+// AuditFields are the fields of AuditRecord which can be redacted
+var AuditFields = []string{
+	"uid", "namespace", "podName", "podGenerateName", "serviceAccount", "workloadIdentityProvider",
+	"serviceAccountEmail", "audience", "tokenExpirationSeconds", "injectionMode", "skippedContainers", "reason",
+}
+
+// AuditLogger writes AuditRecords as JSON lines, separately from the debug log
+type AuditLogger struct {
+	Writer io.Writer
+	// SampleRate is the fraction of the records of the skipped Pods to write. The records of the mutated, denied and
+	// errored Pods are always written so that the identities granted to the Pods can be proven.
+	SampleRate float64
+	// RedactFields are the fields in AuditFields to replace with "REDACTED"
+	RedactFields []string
+
+	mu sync.Mutex
+}
+
+// Log writes the record unless it is sampled out
+func (l *AuditLogger) Log(record AuditRecord) error {
+	if record.Outcome == AuditOutcomeSkipped && l.SampleRate < 1 && rand.Float64() >= l.SampleRate {
+		return nil
+	}
+
+	var line []byte
+	var err error
+	if len(l.RedactFields) == 0 {
+		line, err = json.Marshal(record)
+	} else {
+		line, err = l.redact(record)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.Writer.Write(append(line, '\n'))
+	return err
+}
+
+func (l *AuditLogger) redact(record AuditRecord) ([]byte, error) {
+	marshaled, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	fields := map[string]any{}
+	if err := json.Unmarshal(marshaled, &fields); err != nil {
+		return nil, err
+	}
+	for _, f := range l.RedactFields {
+		if !slices.Contains(AuditFields, f) {
+			return nil, fmt.Errorf("unknown audit field %q", f)
+		}
+		if _, ok := fields[f]; ok {
+			fields[f] = auditRedacted
+		}
+	}
+	return json.Marshal(fields)
+}
+
+// audit records the outcome of the response
+func (r *AuditRecord) audit(resp admission.Response) {
+	if resp.Result != nil {
+		r.Reason = resp.Result.Message
+	}
+	switch {
+	case !resp.Allowed && resp.Result != nil && resp.Result.Reason == metav1.StatusReasonForbidden:
+		r.Outcome = AuditOutcomeDenied
+	case !resp.Allowed:
+		r.Outcome = AuditOutcomeErrored
+	case len(resp.Patches) > 0:
+		r.Outcome = AuditOutcomeMutated
+		if patch, err := json.Marshal(resp.Patches); err == nil {
+			r.PatchSize = len(patch)
+		}
+	default:
+		r.Outcome = AuditOutcomeSkipped
+	}
+}
+
+// auditResolved records the identity resolved for the Pod
+func (r *AuditRecord) auditResolved(idConfig GCPWorkloadIdentityConfig) {
+	if r == nil {
+		return
+	}
+	if idConfig.WorkloadIdentityProvider != nil {
+		r.WorkloadIdentityProvider = *idConfig.WorkloadIdentityProvider
+	}
+	if idConfig.ServiceAccountEmail != nil {
+		r.ServiceAccountEmail = *idConfig.ServiceAccountEmail
+	}
+	if idConfig.Audience != nil {
+		r.Audience = *idConfig.Audience
+	}
+	if idConfig.TokenExpirationSeconds != nil {
+		r.TokenExpirationSeconds = *idConfig.TokenExpirationSeconds
+	}
+	r.InjectionMode = string(idConfig.InjectionMode)
+	r.implicitInjectionMode = idConfig.implicitInjectionMode
+}
+
+// auditSkippedContainer records the container not mutated by the skip-containers annotation or the conflict policy
+func (r *AuditRecord) auditSkippedContainer(name string) {
+	if r == nil {
+		return
+	}
+	r.SkippedContainers = append(r.SkippedContainers, name)
+}
@@ -0,0 +1,151 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestGCPWorkloadIdentityMutator_Handle_audit(t *testing.T) {
+	const namespace = "tenant-a"
+	sas := []*corev1.ServiceAccount{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app", Annotations: map[string]string{
+			idProviderAnnotation:    workloadIdentityProviderFmt,
+			saEmailAnnotation:       "app@project.iam.gserviceaccount.com",
+			injectionModeAnnotation: string(DirectMode),
+		}},
+	}, {
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "default"},
+	}}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sas[0], sas[1]).Build()
+
+	handle := func(t *testing.T, logger *AuditLogger, pod *corev1.Pod) []map[string]any {
+		t.Helper()
+		m := &GCPWorkloadIdentityMutator{
+			AnnotationDomain:       annotaitonDomain,
+			DefaultAudience:        AudienceDefault,
+			DefaultTokenExpiration: DefaultTokenExpirationDefault,
+			MinTokenExpration:      MinTokenExprationDefault,
+			DefaultMode:            VolumeModeDefault,
+			AuditLogger:            logger,
+			Client:                 c,
+			decoder:                admission.NewDecoder(scheme.Scheme),
+		}
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			UID:       "uid",
+			Namespace: namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+
+		var records []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(logger.Writer.(*bytes.Buffer).String()), "\n") {
+			if line == "" {
+				continue
+			}
+			record := map[string]any{}
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("the audit record is not a JSON line: %q", line)
+			}
+			delete(record, "time")
+			records = append(records, record)
+		}
+		return records
+	}
+	mutatedPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:    namespace,
+			GenerateName: "app-",
+			Annotations:  map[string]string{filepath.Join(annotaitonDomain, SkipContainersAnnotation): "istio-proxy"},
+		},
+		Spec: corev1.PodSpec{
+			ServiceAccountName: "app",
+			Containers:         []corev1.Container{{Name: "app", Image: "app"}, {Name: "istio-proxy", Image: "proxy"}},
+		},
+	}
+	skippedPod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "batch"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "default", Containers: []corev1.Container{{Name: "batch", Image: "batch"}}},
+	}
+
+	t.Run("records the identity granted to the Pod", func(t *testing.T) {
+		records := handle(t, &AuditLogger{Writer: &bytes.Buffer{}, SampleRate: 1}, mutatedPod)
+		if len(records) != 1 {
+			t.Fatalf("got %d records, want 1", len(records))
+		}
+		if records[0]["patchSize"].(float64) <= 0 {
+			t.Errorf("patchSize must be positive: %v", records[0]["patchSize"])
+		}
+		delete(records[0], "patchSize")
+		want := map[string]any{
+			"uid":                      "uid",
+			"namespace":                namespace,
+			"podGenerateName":          "app-",
+			"serviceAccount":           "app",
+			"workloadIdentityProvider": workloadIdentityProviderFmt,
+			"serviceAccountEmail":      "app@project.iam.gserviceaccount.com",
+			"audience":                 AudienceDefault,
+			"tokenExpirationSeconds":   float64(DefaultTokenExpirationDefault.Seconds()),
+			"injectionMode":            string(DirectMode),
+			"skippedContainers":        []any{"istio-proxy"},
+			"outcome":                  string(AuditOutcomeMutated),
+		}
+		if diff := cmp.Diff(want, records[0]); diff != "" {
+			t.Errorf("audit record mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("records the skipped Pod", func(t *testing.T) {
+		records := handle(t, &AuditLogger{Writer: &bytes.Buffer{}, SampleRate: 1}, skippedPod)
+		want := []map[string]any{{
+			"uid":            "uid",
+			"namespace":      namespace,
+			"podName":        "batch",
+			"serviceAccount": "default",
+			"outcome":        string(AuditOutcomeSkipped),
+			"patchSize":      float64(0),
+		}}
+		if diff := cmp.Diff(want, records); diff != "" {
+			t.Errorf("audit records mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("samples only the skipped Pods", func(t *testing.T) {
+		if records := handle(t, &AuditLogger{Writer: &bytes.Buffer{}, SampleRate: 0}, skippedPod); len(records) != 0 {
+			t.Errorf("the skipped Pod must be sampled out: %v", records)
+		}
+		if records := handle(t, &AuditLogger{Writer: &bytes.Buffer{}, SampleRate: 0}, mutatedPod); len(records) != 1 {
+			t.Errorf("the mutated Pod must always be recorded: %v", records)
+		}
+	})
+
+	t.Run("redacts the fields", func(t *testing.T) {
+		records := handle(t, &AuditLogger{Writer: &bytes.Buffer{}, SampleRate: 1, RedactFields: []string{"serviceAccountEmail", "podGenerateName"}}, mutatedPod)
+		if len(records) != 1 {
+			t.Fatalf("got %d records, want 1", len(records))
+		}
+		for _, f := range []string{"serviceAccountEmail", "podGenerateName"} {
+			if records[0][f] != auditRedacted {
+				t.Errorf("%s = %v, want redacted", f, records[0][f])
+			}
+		}
+		if records[0]["serviceAccount"] != "app" {
+			t.Errorf("serviceAccount = %v, must not be redacted", records[0]["serviceAccount"])
+		}
+	})
+}
@@ -0,0 +1,82 @@
+package webhooks
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// GCloudBootstrapConfig is the configuration for the built-in credential bootstrap, which writes the
+// same files as `gcloud iam workload-identity-pools create-cred-config` and `gcloud auth login --cred-file`
+// do in the gcloud-setup init container, without requiring the google-cloud-cli image.
+type GCloudBootstrapConfig struct {
+	WorkloadIdentityProvider string
+	ServiceAccountEmail      string
+	Project                  string
+	Region                   string
+	// ConfigDir is the gcloud configuration directory, i.e. CLOUDSDK_CONFIG
+	ConfigDir string
+	// CredentialSourceFile is the path to the projected Kubernetes ServiceAccount token
+	CredentialSourceFile string
+}
+
+// Write writes the external account credentials file and a minimal gcloud configuration directory
+// whose active configuration uses the credentials file for the service account.
+func (c GCloudBootstrapConfig) Write() error {
+	if c.WorkloadIdentityProvider == "" || c.ServiceAccountEmail == "" || c.ConfigDir == "" {
+		return fmt.Errorf("workload identity provider, service account email and config dir must be set")
+	}
+	if !workloadIdentityProviderRegex.MatchString(c.WorkloadIdentityProvider) {
+		return fmt.Errorf("workload identity provider must be form of %s", workloadIdentityProviderFmt)
+	}
+
+	creds := NewExternalAccountCredentials(fmt.Sprintf("//iam.googleapis.com/%s", c.WorkloadIdentityProvider), c.ServiceAccountEmail)
+	if c.CredentialSourceFile != "" {
+		creds.CredentialSource.File = c.CredentialSourceFile
+	}
+	credJson, err := creds.Render(true)
+	if err != nil {
+		return err
+	}
+
+	configurationsDir := filepath.Join(c.ConfigDir, "configurations")
+	if err := os.MkdirAll(configurationsDir, 0755); err != nil {
+		return fmt.Errorf("could not create gcloud configurations directory: %w", err)
+	}
+
+	credFile := filepath.Join(c.ConfigDir, ExternalCredConfigFilename)
+	if err := os.WriteFile(credFile, []byte(credJson), 0644); err != nil {
+		return fmt.Errorf("could not write %s: %w", credFile, err)
+	}
+
+	if err := os.WriteFile(filepath.Join(configurationsDir, "config_"+gcloudConfigurationName), []byte(c.renderGCloudProperties(credFile)), 0644); err != nil {
+		return fmt.Errorf("could not write gcloud configuration: %w", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(c.ConfigDir, "active_config"), []byte(gcloudConfigurationName), 0644); err != nil {
+		return fmt.Errorf("could not write gcloud active configuration: %w", err)
+	}
+
+	return nil
+}
+
+const gcloudConfigurationName = "default"
+
+// renderGCloudProperties renders the gcloud properties file (INI format) of the active configuration.
+// auth/credential_file_override makes gcloud use the credentials file without `gcloud auth login`.
+func (c GCloudBootstrapConfig) renderGCloudProperties(credFile string) string {
+	b := &strings.Builder{}
+	b.WriteString("[core]\n")
+	fmt.Fprintf(b, "account = %s\n", c.ServiceAccountEmail)
+	if c.Project != "" {
+		fmt.Fprintf(b, "project = %s\n", c.Project)
+	}
+	b.WriteString("\n[auth]\n")
+	fmt.Fprintf(b, "credential_file_override = %s\n", credFile)
+	if c.Region != "" {
+		b.WriteString("\n[compute]\n")
+		fmt.Fprintf(b, "region = %s\n", c.Region)
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGCloudBootstrapConfig_Write(t *testing.T) {
+	const (
+		workloadIdProvider = "projects/12345/locations/global/workloadIdentityPools/on-prem-kubernetes/providers/this-cluster"
+		saEmail            = "app-x@project.iam.gserviceaccount.com"
+	)
+
+	t.Run("writes credentials and gcloud configuration", func(t *testing.T) {
+		dir := t.TempDir()
+		c := GCloudBootstrapConfig{
+			WorkloadIdentityProvider: workloadIdProvider,
+			ServiceAccountEmail:      saEmail,
+			Project:                  "project",
+			Region:                   "asia-northeast1",
+			ConfigDir:                dir,
+		}
+		if err := c.Write(); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+
+		credJson, err := os.ReadFile(filepath.Join(dir, ExternalCredConfigFilename))
+		if err != nil {
+			t.Fatalf("credentials file is not written: %v", err)
+		}
+		creds := ExternalAccountCredentials{}
+		if err := json.Unmarshal(credJson, &creds); err != nil {
+			t.Fatalf("credentials file is not valid json: %v", err)
+		}
+		if want := *NewExternalAccountCredentials("//iam.googleapis.com/"+workloadIdProvider, saEmail); creds != want {
+			t.Errorf("credentials = %+v, want %+v", creds, want)
+		}
+
+		activeConfig, err := os.ReadFile(filepath.Join(dir, "active_config"))
+		if err != nil {
+			t.Fatalf("active_config is not written: %v", err)
+		}
+		if string(activeConfig) != "default" {
+			t.Errorf("active_config = %q, want %q", activeConfig, "default")
+		}
+
+		properties, err := os.ReadFile(filepath.Join(dir, "configurations", "config_default"))
+		if err != nil {
+			t.Fatalf("configuration is not written: %v", err)
+		}
+		want := `[core]
+account = app-x@project.iam.gserviceaccount.com
+project = project
+
+[auth]
+credential_file_override = ` + filepath.Join(dir, ExternalCredConfigFilename) + `
+
+[compute]
+region = asia-northeast1
+`
+		if string(properties) != want {
+			t.Errorf("configuration = %q, want %q", properties, want)
+		}
+	})
+
+	t.Run("overrides credential source file", func(t *testing.T) {
+		dir := t.TempDir()
+		c := GCloudBootstrapConfig{
+			WorkloadIdentityProvider: workloadIdProvider,
+			ServiceAccountEmail:      saEmail,
+			ConfigDir:                dir,
+			CredentialSourceFile:     "/token",
+		}
+		if err := c.Write(); err != nil {
+			t.Fatalf("Write() returned unexpected error: %v", err)
+		}
+		credJson, _ := os.ReadFile(filepath.Join(dir, ExternalCredConfigFilename))
+		creds := ExternalAccountCredentials{}
+		if err := json.Unmarshal(credJson, &creds); err != nil {
+			t.Fatalf("credentials file is not valid json: %v", err)
+		}
+		if creds.CredentialSource.File != "/token" {
+			t.Errorf("credential source file = %q, want %q", creds.CredentialSource.File, "/token")
+		}
+	})
+
+	t.Run("rejects malformed workload identity provider", func(t *testing.T) {
+		c := GCloudBootstrapConfig{
+			WorkloadIdentityProvider: "malformed",
+			ServiceAccountEmail:      saEmail,
+			ConfigDir:                t.TempDir(),
+		}
+		if err := c.Write(); err == nil {
+			t.Errorf("Write() should return error")
+		}
+	})
+}
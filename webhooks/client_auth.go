@@ -0,0 +1,46 @@
+package webhooks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// ClientCertVerification returns the TLS option of the webhook server which requires the clients, i.e. the
+// kube-apiserver, to present a certificate signed by the CA in caFile, so that the others can't submit
+// AdmissionReviews causing ServiceAccount lookups. If names are given, the certificate must also have one of them as
+// the common name or a DNS name.
+//
+// The readiness check of the webhook server still succeeds without a client certificate because the client side of
+// the TLS 1.3 handshake completes before the server verifies the client certificate.
+func ClientCertVerification(caFile string, names []string) (func(*tls.Config), error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates in %s", caFile)
+	}
+
+	return func(c *tls.Config) {
+		c.ClientCAs = pool
+		c.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(names) == 0 {
+			return
+		}
+		c.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("no client certificate")
+			}
+			cert := cs.PeerCertificates[0]
+			if slices.Contains(names, cert.Subject.CommonName) || slices.ContainsFunc(cert.DNSNames, func(name string) bool { return slices.Contains(names, name) }) {
+				return nil
+			}
+			return fmt.Errorf("client certificate %q is not allowed", cert.Subject.CommonName)
+		}
+	}, nil
+}
@@ -0,0 +1,121 @@
+package webhooks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestClientCertVerification(t *testing.T) {
+	now := time.Now()
+	ca, caKey, err := generateCA(now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile := filepath.Join(t.TempDir(), "client-ca.crt")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	otherCA, otherCAKey, err := generateCA(now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert := func(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, commonName string) tls.Certificate {
+		t.Helper()
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: commonName},
+			NotBefore:    now.Add(-time.Minute),
+			NotAfter:     now.Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		}, ca, key.Public(), caKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+
+	serve := func(t *testing.T, names []string) *httptest.Server {
+		t.Helper()
+		opt, err := ClientCertVerification(caFile, names)
+		if err != nil {
+			t.Fatalf("ClientCertVerification() returned unexpected error: %v", err)
+		}
+		server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}))
+		server.TLS = &tls.Config{}
+		opt(server.TLS)
+		server.StartTLS()
+		t.Cleanup(server.Close)
+		return server
+	}
+	get := func(server *httptest.Server, certs ...tls.Certificate) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: certs}}}
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+
+	t.Run("accepts only the clients with a certificate signed by the CA", func(t *testing.T) {
+		server := serve(t, nil)
+		if err := get(server, clientCert(t, ca, caKey, "kube-apiserver")); err != nil {
+			t.Errorf("the client with a valid certificate is rejected: %v", err)
+		}
+		if err := get(server); err == nil {
+			t.Error("the client without certificate must be rejected")
+		}
+		if err := get(server, clientCert(t, otherCA, otherCAKey, "kube-apiserver")); err == nil {
+			t.Error("the client with a certificate signed by another CA must be rejected")
+		}
+	})
+
+	t.Run("accepts only the allowed names", func(t *testing.T) {
+		server := serve(t, []string{"kube-apiserver"})
+		if err := get(server, clientCert(t, ca, caKey, "kube-apiserver")); err != nil {
+			t.Errorf("the allowed client is rejected: %v", err)
+		}
+		if err := get(server, clientCert(t, ca, caKey, "someone")); err == nil {
+			t.Error("the client with a name not allowed must be rejected")
+		}
+	})
+
+	t.Run("the readiness check of the webhook server can connect without certificate", func(t *testing.T) {
+		server := serve(t, nil)
+		// the same as webhook.DefaultServer.StartedChecker
+		conn, err := tls.Dial("tcp", server.Listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("tls.Dial() returned unexpected error: %v", err)
+		}
+		if err := conn.Close(); err != nil {
+			t.Errorf("Close() returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("fails without certificates in the CA file", func(t *testing.T) {
+		empty := filepath.Join(t.TempDir(), "empty.crt")
+		if err := os.WriteFile(empty, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ClientCertVerification(empty, nil); err == nil {
+			t.Error("ClientCertVerification() must fail")
+		}
+	})
+}
@@ -0,0 +1,81 @@
+package webhooks
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// ConflictPolicy decides what the webhook does when a Pod already has a volume, volumeMount or container
+// which collides with the injected one
+type ConflictPolicy string
+
+const (
+	// ConflictPolicyReplace replaces (or removes) the colliding ones with a warning
+	ConflictPolicyReplace ConflictPolicy = "replace"
+	// ConflictPolicySkipContainer leaves containers with colliding volumeMounts unmutated with a warning.
+	// Colliding volumes and containers can't be resolved per container and are rejected.
+	ConflictPolicySkipContainer ConflictPolicy = "skip-container"
+	// ConflictPolicyReject rejects the Pod
+	ConflictPolicyReject ConflictPolicy = "reject"
+)
+
+var ConflictPolicies = []ConflictPolicy{ConflictPolicyReplace, ConflictPolicySkipContainer, ConflictPolicyReject}
+
+// conflictError is the admission message of the Pod rejected by the conflict policy
+func conflictError(policy ConflictPolicy, conflicts ...string) error {
+	return fmt.Errorf("the Pod conflicts with the configurations injected by the webhook (conflict policy: %s): %s", policy, strings.Join(conflicts, "; "))
+}
+
+// volumeConflict describes the volume in volumes which has the same name as volume but differs, if any
+func volumeConflict(volumes []corev1.Volume, volume corev1.Volume) string {
+	for _, v := range volumes {
+		if v.Name == volume.Name && !equality.Semantic.DeepEqual(v, volume) {
+			return fmt.Sprintf("volume %q already exists with a different source", volume.Name)
+		}
+	}
+	return ""
+}
+
+// containerConflict describes the container in ctrs which has the same name as ctr but differs, if any
+func containerConflict(ctrs []corev1.Container, ctr corev1.Container) string {
+	for _, c := range ctrs {
+		if c.Name == ctr.Name && !equality.Semantic.DeepEqual(c, ctr) {
+			return fmt.Sprintf("container %q already exists with a different spec", ctr.Name)
+		}
+	}
+	return ""
+}
+
+// volumeMountConflicts describes the volumeMounts of ctr which have the same name as, or are mounted at the same path as,
+// one of volumeMountsToAdd but differ from it
+func volumeMountConflicts(ctr corev1.Container, volumeMountsToAdd []corev1.VolumeMount) []string {
+	var conflicts []string
+	for _, toAdd := range volumeMountsToAdd {
+		for _, vm := range ctr.VolumeMounts {
+			switch {
+			case vm.Name == toAdd.Name && !equality.Semantic.DeepEqual(vm, toAdd):
+				conflicts = append(conflicts, fmt.Sprintf("volumeMount %q of container %q differs from the injected one", vm.Name, ctr.Name))
+			case vm.Name != toAdd.Name && vm.MountPath == toAdd.MountPath:
+				conflicts = append(conflicts, fmt.Sprintf("volumeMount %q of container %q is mounted at %s where volume %q is injected", vm.Name, ctr.Name, vm.MountPath, toAdd.Name))
+			}
+		}
+	}
+	return conflicts
+}
+
+// removeVolumeMountsAt removes the volumeMounts at mountPath other than the one named name
+func removeVolumeMountsAt(patch *podPatch, path string, volumeMounts []corev1.VolumeMount, name, mountPath string) []corev1.VolumeMount {
+	var result []corev1.VolumeMount
+	for _, vm := range volumeMounts {
+		if vm.Name != name && vm.MountPath == mountPath {
+			// the index in the list from which the preceding ones are already removed
+			patch.remove(indexOf(path, len(result)))
+			continue
+		}
+		result = append(result, vm)
+	}
+	return result
+}
@@ -12,6 +12,7 @@ const (
 	GcloudImageDefault            = "gcr.io/google.com/cloudsdktool/google-cloud-cli:stable"
 	VolumeModeDefault             = 0440
 	SetupContainerResources       = ""
+	SkipPodLabelDefault           = "gcp-workload-identity-federation-webhook/skip"
 
 	// Constants for injected fields
 	DirectInjectedExternalVolumeName = "external-credential-config"
@@ -23,4 +24,18 @@ const (
 	GCloudConfigVolumeName           = "gcloud-config"
 	GCloudConfigMountPath            = "/var/run/secrets/gcloud/config"
 	GCloudSetupInitContainerName     = "gcloud-setup"
+	BootstrapCommand                 = "/gcp-workload-identity-federation-webhook"
+	MetadataServerContainerName      = "gcp-metadata-server"
+	MetadataServerAddress            = "127.0.0.1:8988"
+	AccessTokenRefresherName         = "gcp-access-token-refresher"
+	AccessTokenVolumeName            = "gcp-access-token"
+	AccessTokenMountPath             = "/var/run/secrets/gcp-access-token"
+	AccessTokenFilename              = "token"
+	IdentityCredentialsVolumeName    = "gcp-identity-credentials"
+	IdentityCredentialsMountPath     = "/var/run/secrets/gcp-identities"
+
+	// Labels and annotations for image pull secrets copied by ImagePullSecretSyncer
+	ImagePullSecretManagedByLabel   = "app.kubernetes.io/managed-by"
+	ImagePullSecretManagedByValue   = "gcp-workload-identity-federation-webhook"
+	ImagePullSecretSourceAnnotation = "copied-from" // prefixed with the annotation domain
 )
@@ -0,0 +1,506 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"math"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	apivalidation "k8s.io/apimachinery/pkg/api/validation"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/ptr"
+)
+
+const fuzzProvider = "projects/123/locations/global/workloadIdentityPools/pool/providers/provider"
+
+// fuzzAnnotations returns the annotations in the domain of the non-empty values, e.g. "audience=..."
+func fuzzAnnotations(kvs ...string) map[string]string {
+	annotations := map[string]string{}
+	for i := 0; i+1 < len(kvs); i += 2 {
+		if kvs[i+1] != "" {
+			annotations[filepath.Join(AnnotationDomainDefault, kvs[i])] = kvs[i+1]
+		}
+	}
+	return annotations
+}
+
+// mergeFuzzAnnotations merges the "key=value" lines of extra into annotations, e.g. to cover the annotations
+// of the other identities, the ones out of the domain and the ones with invalid keys
+func mergeFuzzAnnotations(annotations map[string]string, extra string) map[string]string {
+	for _, line := range strings.Split(extra, "\n") {
+		if k, v, ok := strings.Cut(line, "="); ok {
+			annotations[k] = v
+		}
+	}
+	return annotations
+}
+
+func FuzzNewGCPWorkloadIdentityConfig(f *testing.F) {
+	f.Add(fuzzProvider, "app@project.iam.gserviceaccount.com", "", "", "", "", "", "", "", "")
+	f.Add(fuzzProvider, "app@project.iam.gserviceaccount.com", "my-audience", "6h", "1000", "direct", "org-b", "1h", "metadata", "")
+	f.Add(fuzzProvider, "", "", "-1", "x", "GCLOUD", "Org_B", "0", "unknown", "")
+	f.Add("projects/1/locations/2/workloadIdentityPools/3/providers/4", "a", "", "9223372036854775807", "-1", "access-token", "", "1e300h", "", "")
+	f.Add(fuzzProvider, "app@project.iam.gserviceaccount.com", "", "", "", "", "", "", "",
+		AnnotationDomainDefault+"/audience.org-c=aud\n"+AnnotationDomainDefault+"/service-account-email.org-c=c@project.iam.gserviceaccount.com\nexample.com/audience=x")
+	f.Add(fuzzProvider, "app@project.iam.gserviceaccount.com", "", "", "", "", "", "", "",
+		AnnotationDomainDefault+"/workload-identity-provider.=x\n"+AnnotationDomainDefault+"/token-expiration.org-b=1h\n=")
+	f.Fuzz(func(t *testing.T, provider, email, audience, tokenExpiration, runAsUser, mode, identity, podTokenExpiration, podMode, extraAnnotations string) {
+		annotations := fuzzAnnotations(
+			WorkloadIdentityProviderAnnotation, provider,
+			ServiceAccountEmailAnnotation, email,
+			AudienceAnnotation, audience,
+			TokenExpirationAnnotation, tokenExpiration,
+			RunAsUserAnnotation, runAsUser,
+			InjectionModeAnnotation, mode,
+		)
+		annotations = mergeFuzzAnnotations(annotations, extraAnnotations)
+		if identity != "" {
+			annotations[filepath.Join(AnnotationDomainDefault, WorkloadIdentityProviderAnnotation)+"."+identity] = provider
+			annotations[filepath.Join(AnnotationDomainDefault, ServiceAccountEmailAnnotation)+"."+identity] = email
+		}
+		sa := corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: annotations}}
+		cfg, err := NewGCPWorkloadIdentityConfig(AnnotationDomainDefault, sa)
+		if err != nil || cfg == nil {
+			return
+		}
+		if cfg.WorkloadIdentityProvider == nil || cfg.ServiceAccountEmail == nil || !workloadIdentityProviderRegex.MatchString(*cfg.WorkloadIdentityProvider) {
+			t.Errorf("invalid default identity: %+v", cfg)
+		}
+		if cfg.RunAsUser != nil && (*cfg.RunAsUser < 0 || *cfg.RunAsUser > math.MaxInt32) {
+			t.Errorf("runAsUser out of range: %d", *cfg.RunAsUser)
+		}
+		for _, id := range cfg.AdditionalIdentities {
+			if errs := validation.IsDNS1123Label(id.Name); len(errs) > 0 {
+				t.Errorf("invalid additional identity name %q: %v", id.Name, errs)
+			}
+		}
+
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: mergeFuzzAnnotations(fuzzAnnotations(
+			TokenExpirationAnnotation, podTokenExpiration,
+			InjectionModeAnnotation, podMode,
+		), extraAnnotations)}}
+		m := newPatchTestMutator()
+		resolved, _, err := cfg.Resolve(AnnotationDomainDefault, pod, PodOverridableAnnotations, m.resolveDefaults())
+		if err != nil {
+			return
+		}
+		if resolved.Audience == nil || resolved.TokenExpirationSeconds == nil || !slices.Contains(InjectionModes, resolved.InjectionMode) {
+			t.Errorf("unresolved configuration: %+v", resolved)
+		}
+		if *resolved.TokenExpirationSeconds < int64(m.MinTokenExpration.Seconds()) || *resolved.TokenExpirationSeconds > maxTokenExpirationSeconds {
+			t.Errorf("token expiration %d is out of the range", *resolved.TokenExpirationSeconds)
+		}
+		for _, id := range resolved.AdditionalIdentities {
+			if id.Audience == nil {
+				t.Errorf("unresolved audience of the additional identity %q", id.Name)
+			}
+		}
+	})
+}
+
+func FuzzGCPWorkloadIdentityMutator_mutatePod(f *testing.F) {
+	f.Add("", "", "", "", "", "", "app", "LOG_LEVEL", "data", "/data", "")
+	f.Add("direct", "my-audience", "org-b", "7200", "1000", "app", "app", "CLOUDSDK_CONFIG", "gcloud", "/var/run/secrets/gcloud/config", "")
+	f.Add("metadata", "", "", "", "", "missing,app", "gcloud-setup", "GOOGLE_APPLICATION_CREDENTIALS", "gcp-iam-token", "/var/run/secrets/sts.googleapis.com/serviceaccount", "")
+	f.Add("access-token", "", "", "5000000000", "", "", "app", "CLOUDSDK_CORE_PROJECT", "gcp-access-token", "/var/run/secrets", "")
+	f.Add("gcloud", "aud", "a", "1", "0", " , ", "gcp-metadata-server", "A", "gcp-identity-credentials", "/var/run/secrets/gcp-identities", "")
+	f.Add("", "", "org-b", "", "", "", "app", "A", "data", "/data",
+		AnnotationDomainDefault+"/audience.org-b=aud\n"+AnnotationDomainDefault+"/external-credentials-json={}\n"+AnnotationDomainDefault+"/preview-injection-mode=gcloud")
+	f.Add("", "", "", "", "", "", "app", "A", "data", "/data", "example.com/token-expiration=1h\n"+AnnotationDomainDefault+"/injection-mode=direct\nInvalid Key=x")
+	f.Fuzz(func(t *testing.T, mode, audience, identity, podTokenExpiration, runAsUser, skipContainers, ctrName, envName, volumeName, mountPath, extraAnnotations string) {
+		saAnnotations := fuzzAnnotations(
+			WorkloadIdentityProviderAnnotation, fuzzProvider,
+			ServiceAccountEmailAnnotation, "app@project.iam.gserviceaccount.com",
+			AudienceAnnotation, audience,
+			RunAsUserAnnotation, runAsUser,
+			InjectionModeAnnotation, mode,
+		)
+		saAnnotations = mergeFuzzAnnotations(saAnnotations, extraAnnotations)
+		if identity != "" {
+			saAnnotations[filepath.Join(AnnotationDomainDefault, WorkloadIdentityProviderAnnotation)+"."+identity] = fuzzProvider
+			saAnnotations[filepath.Join(AnnotationDomainDefault, ServiceAccountEmailAnnotation)+"."+identity] = "org-b@project.iam.gserviceaccount.com"
+		}
+		// the webhook receives the objects in JSON, which can't carry invalid UTF-8 for example
+		saAnnotations = roundTrip(t, saAnnotations)
+		if len(apivalidation.ValidateAnnotations(saAnnotations, field.NewPath("metadata", "annotations"))) > 0 {
+			// the API server never admits such a ServiceAccount
+			return
+		}
+		cfg, err := NewGCPWorkloadIdentityConfig(AnnotationDomainDefault, corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Annotations: saAnnotations}})
+		if err != nil || cfg == nil {
+			return
+		}
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "app",
+				Annotations: mergeFuzzAnnotations(fuzzAnnotations(
+					TokenExpirationAnnotation, podTokenExpiration,
+					SkipContainersAnnotation, skipContainers,
+				), extraAnnotations),
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: "app",
+				InitContainers:     []corev1.Container{{Name: "init", Image: "busybox"}},
+				Containers: []corev1.Container{{
+					Name:         ctrName,
+					Image:        "app",
+					Env:          []corev1.EnvVar{{Name: envName, Value: "value"}},
+					VolumeMounts: []corev1.VolumeMount{{Name: volumeName, MountPath: mountPath}},
+				}},
+				Volumes: []corev1.Volume{{Name: volumeName, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+			},
+		}
+		raw, err := json.Marshal(pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pod = roundTrip(t, pod)
+		if len(validatePod(pod)) > 0 {
+			return
+		}
+
+		m := newPatchTestMutator()
+		m.PodOverridableAnnotations = PodOverridableAnnotations
+		patches, _, err := m.mutatePod(pod, *cfg, podSecurity{}, nil)
+		if err != nil {
+			return
+		}
+		if errs := validatePod(pod); len(errs) > 0 {
+			t.Fatalf("the mutated Pod is invalid: %v", errs.ToAggregate())
+		}
+
+		patch, err := json.Marshal(patches)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := decoded.Apply(raw)
+		if err != nil {
+			t.Fatalf("failed to apply the patch: %v", err)
+		}
+		actual := &corev1.Pod{}
+		if err := json.Unmarshal(patched, actual); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(pod, actual); diff != "" {
+			t.Fatalf("patched Pod mismatch with the mutated one (-want +got):\n%s", diff)
+		}
+
+		patches, _, err = m.mutatePod(actual, *cfg, podSecurity{}, nil)
+		if err != nil {
+			t.Fatalf("mutatePod() returned unexpected error for the mutated Pod: %v", err)
+		}
+		if len(patches) > 0 {
+			t.Errorf("mutatePod() is not idempotent: %v", patches)
+		}
+		if diff := cmp.Diff(pod, actual); diff != "" {
+			t.Errorf("mutatePod() is not idempotent (-want +got):\n%s", diff)
+		}
+	})
+}
+
+// roundTrip returns obj marshaled and unmarshaled in JSON
+func roundTrip[T any](t *testing.T, obj T) T {
+	t.Helper()
+	data, err := json.Marshal(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result T
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// validatePod is the subset of the Pod validation of the API server covering the fields which mutatePod sets,
+// because k8s.io/kubernetes is not meant to be imported. The comments name the functions of
+// k8s.io/kubernetes/pkg/apis/core/validation mirrored by the checks.
+func validatePod(pod *corev1.Pod) field.ErrorList {
+	// ValidateObjectMeta
+	errs := apivalidation.ValidateAnnotations(pod.Annotations, field.NewPath("metadata", "annotations"))
+
+	// validateVolumes
+	volumes := sets.New[string]()
+	for i, v := range pod.Spec.Volumes {
+		fldPath := field.NewPath("spec", "volumes").Index(i)
+		for _, msg := range validation.IsDNS1123Label(v.Name) {
+			errs = append(errs, field.Invalid(fldPath.Child("name"), v.Name, msg))
+		}
+		if volumes.Has(v.Name) {
+			errs = append(errs, field.Duplicate(fldPath.Child("name"), v.Name))
+		}
+		volumes.Insert(v.Name)
+		errs = append(errs, validateVolumeSource(v.VolumeSource, fldPath)...)
+	}
+
+	// validateInitContainers and validateContainers, where the names are unique across both
+	containers := sets.New[string]()
+	validateContainers := func(ctrs []corev1.Container, fldPath *field.Path) {
+		for i, c := range ctrs {
+			fldPath := fldPath.Index(i)
+			for _, msg := range validation.IsDNS1123Label(c.Name) {
+				errs = append(errs, field.Invalid(fldPath.Child("name"), c.Name, msg))
+			}
+			if containers.Has(c.Name) {
+				errs = append(errs, field.Duplicate(fldPath.Child("name"), c.Name))
+			}
+			containers.Insert(c.Name)
+			if c.Image == "" {
+				errs = append(errs, field.Required(fldPath.Child("image"), ""))
+			}
+			// validateEnv
+			envs := sets.New[string]()
+			for j, e := range c.Env {
+				for _, msg := range validation.IsEnvVarName(e.Name) {
+					errs = append(errs, field.Invalid(fldPath.Child("env").Index(j).Child("name"), e.Name, msg))
+				}
+				// duplicates are only warned by the API server (warningsForPodSpecAndMeta), but the webhook must not add them
+				if envs.Has(e.Name) {
+					errs = append(errs, field.Duplicate(fldPath.Child("env").Index(j).Child("name"), e.Name))
+				}
+				envs.Insert(e.Name)
+			}
+			// ValidateVolumeMounts
+			mountPaths := sets.New[string]()
+			for j, vm := range c.VolumeMounts {
+				fldPath := fldPath.Child("volumeMounts").Index(j)
+				if !volumes.Has(vm.Name) {
+					errs = append(errs, field.NotFound(fldPath.Child("name"), vm.Name))
+				}
+				if vm.MountPath == "" {
+					errs = append(errs, field.Required(fldPath.Child("mountPath"), ""))
+				}
+				if mountPaths.Has(vm.MountPath) {
+					errs = append(errs, field.Invalid(fldPath.Child("mountPath"), vm.MountPath, "must be unique"))
+				}
+				mountPaths.Insert(vm.MountPath)
+			}
+			// ValidateSecurityContext
+			if sc := c.SecurityContext; sc != nil && sc.RunAsUser != nil {
+				for _, msg := range validation.IsValidUserID(*sc.RunAsUser) {
+					errs = append(errs, field.Invalid(fldPath.Child("securityContext", "runAsUser"), *sc.RunAsUser, msg))
+				}
+			}
+		}
+	}
+	validateContainers(pod.Spec.InitContainers, field.NewPath("spec", "initContainers"))
+	validateContainers(pod.Spec.Containers, field.NewPath("spec", "containers"))
+	return errs
+}
+
+// validateVolumeSource mirrors validateVolumeSource for the volume types which the webhook adds
+func validateVolumeSource(source corev1.VolumeSource, fldPath *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	// the checks of defaultMode with fileModeErrorMsg
+	validateMode := func(mode *int32, fldPath *field.Path) {
+		if mode != nil && (*mode < 0 || *mode > 0o777) {
+			errs = append(errs, field.Invalid(fldPath, *mode, "must be a number between 0 and 0777 (octal)"))
+		}
+	}
+	// validateLocalNonReservedPath, and the conflicting duplicate paths of validateProjectionSources
+	paths := sets.New[string]()
+	validatePath := func(p string, fldPath *field.Path) {
+		if p == "" || path.IsAbs(p) || slices.Contains(strings.Split(p, "/"), "..") {
+			errs = append(errs, field.Invalid(fldPath, p, "must be a relative path without '..'"))
+		}
+		if paths.Has(p) {
+			errs = append(errs, field.Duplicate(fldPath, p))
+		}
+		paths.Insert(p)
+	}
+	switch {
+	case source.Projected != nil: // validateProjectedVolumeSource
+		validateMode(source.Projected.DefaultMode, fldPath.Child("projected", "defaultMode"))
+		for i, s := range source.Projected.Sources {
+			if s.ServiceAccountToken == nil {
+				continue
+			}
+			fldPath := fldPath.Child("projected", "sources").Index(i).Child("serviceAccountToken")
+			validatePath(s.ServiceAccountToken.Path, fldPath.Child("path"))
+			if s := s.ServiceAccountToken.ExpirationSeconds; s != nil && (*s < 10*60 || *s > 1<<32) {
+				errs = append(errs, field.Invalid(fldPath.Child("expirationSeconds"), *s, "must be between 10 minutes and 2^32 seconds"))
+			}
+		}
+	case source.DownwardAPI != nil: // validateDownwardAPIVolumeSource
+		validateMode(source.DownwardAPI.DefaultMode, fldPath.Child("downwardAPI", "defaultMode"))
+		for i, item := range source.DownwardAPI.Items {
+			validatePath(item.Path, fldPath.Child("downwardAPI", "items").Index(i).Child("path"))
+		}
+	case source.EmptyDir == nil && source.Secret == nil: // numVolumes == 0
+		errs = append(errs, field.Required(fldPath, "must specify a supported volume type"))
+	}
+	return errs
+}
+
+func TestValidatePod(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(pod *corev1.Pod)
+		field  string // of the expected error, valid if empty
+	}{
+		{name: "valid", mutate: func(pod *corev1.Pod) {}},
+		{
+			name:   "invalid annotation key",
+			mutate: func(pod *corev1.Pod) { pod.Annotations = map[string]string{"invalid key": "x"} },
+			field:  "metadata.annotations",
+		},
+		{
+			name:   "invalid volume name",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Volumes[0].Name = "Data" },
+			field:  "spec.volumes[0].name",
+		},
+		{
+			name:   "duplicate volume name",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Volumes[1].Name = "data" },
+			field:  "spec.volumes[1].name",
+		},
+		{
+			name:   "no volume type",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Volumes[0].EmptyDir = nil },
+			field:  "spec.volumes[0]",
+		},
+		{
+			name:   "invalid defaultMode",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Volumes[1].Projected.DefaultMode = ptr.To[int32](0o1000) },
+			field:  "spec.volumes[1].projected.defaultMode",
+		},
+		{
+			name:   "absolute token path",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Volumes[1].Projected.Sources[0].ServiceAccountToken.Path = "/token" },
+			field:  "spec.volumes[1].projected.sources[0].serviceAccountToken.path",
+		},
+		{
+			name:   "token path with '..'",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Volumes[1].Projected.Sources[0].ServiceAccountToken.Path = "../token" },
+			field:  "spec.volumes[1].projected.sources[0].serviceAccountToken.path",
+		},
+		{
+			name: "duplicate token path",
+			mutate: func(pod *corev1.Pod) {
+				sources := &pod.Spec.Volumes[1].Projected.Sources
+				*sources = append(*sources, *(*sources)[0].DeepCopy())
+			},
+			field: "spec.volumes[1].projected.sources[1].serviceAccountToken.path",
+		},
+		{
+			name: "short token expiration",
+			mutate: func(pod *corev1.Pod) {
+				pod.Spec.Volumes[1].Projected.Sources[0].ServiceAccountToken.ExpirationSeconds = ptr.To[int64](60)
+			},
+			field: "spec.volumes[1].projected.sources[0].serviceAccountToken.expirationSeconds",
+		},
+		{
+			name: "empty downwardAPI path",
+			mutate: func(pod *corev1.Pod) {
+				pod.Spec.Volumes[0].VolumeSource = corev1.VolumeSource{DownwardAPI: &corev1.DownwardAPIVolumeSource{
+					Items: []corev1.DownwardAPIVolumeFile{{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}}},
+				}}
+			},
+			field: "spec.volumes[0].downwardAPI.items[0].path",
+		},
+		{
+			name:   "invalid container name",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].Name = "app_1" },
+			field:  "spec.containers[0].name",
+		},
+		{
+			name:   "container name duplicated with an init container",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].Name = "init" },
+			field:  "spec.containers[0].name",
+		},
+		{
+			name:   "no image",
+			mutate: func(pod *corev1.Pod) { pod.Spec.InitContainers[0].Image = "" },
+			field:  "spec.initContainers[0].image",
+		},
+		{
+			name:   "invalid env name",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].Env[0].Name = "1=A" },
+			field:  "spec.containers[0].env[0].name",
+		},
+		{
+			name: "duplicate env name",
+			mutate: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].Env = append(pod.Spec.Containers[0].Env, corev1.EnvVar{Name: "A"})
+			},
+			field: "spec.containers[0].env[1].name",
+		},
+		{
+			name:   "mount of a missing volume",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].VolumeMounts[0].Name = "missing" },
+			field:  "spec.containers[0].volumeMounts[0].name",
+		},
+		{
+			name:   "empty mountPath",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].VolumeMounts[0].MountPath = "" },
+			field:  "spec.containers[0].volumeMounts[0].mountPath",
+		},
+		{
+			name:   "duplicate mountPath",
+			mutate: func(pod *corev1.Pod) { pod.Spec.Containers[0].VolumeMounts[1].MountPath = "/data" },
+			field:  "spec.containers[0].volumeMounts[1].mountPath",
+		},
+		{
+			name: "negative runAsUser",
+			mutate: func(pod *corev1.Pod) {
+				pod.Spec.InitContainers[0].SecurityContext = &corev1.SecurityContext{RunAsUser: ptr.To[int64](-1)}
+			},
+			field: "spec.initContainers[0].securityContext.runAsUser",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+				Containers: []corev1.Container{{
+					Name:  "app",
+					Image: "app",
+					Env:   []corev1.EnvVar{{Name: "A", Value: "value"}},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "data", MountPath: "/data"},
+						{Name: "token", MountPath: "/var/run/secrets/token"},
+					},
+				}},
+				Volumes: []corev1.Volume{
+					{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+					{Name: "token", VolumeSource: corev1.VolumeSource{Projected: &corev1.ProjectedVolumeSource{
+						Sources: []corev1.VolumeProjection{{ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Path:              "token",
+							ExpirationSeconds: ptr.To[int64](3600),
+						}}},
+					}}},
+				},
+			}}
+			tt.mutate(pod)
+
+			errs := validatePod(pod)
+			if tt.field == "" {
+				if len(errs) > 0 {
+					t.Errorf("validatePod() returned unexpected errors: %v", errs.ToAggregate())
+				}
+				return
+			}
+			found := false
+			for _, err := range errs {
+				found = found || err.Field == tt.field
+			}
+			if !found {
+				t.Errorf("validatePod() errors = %v, want an error of %s", errs.ToAggregate(), tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jsonpatchv5 "github.com/evanphx/json-patch/v5"
+	"github.com/google/go-cmp/cmp"
+	"gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+	"sigs.k8s.io/yaml"
+)
+
+var update = flag.Bool("update", false, "update the golden files in testdata")
+
+// goldenResponse is the part of the admission response compared with response.golden.yaml
+type goldenResponse struct {
+	Allowed  bool                  `json:"allowed"`
+	Message  string                `json:"message,omitempty"`
+	Warnings []string              `json:"warnings,omitempty"`
+	Patch    []jsonpatch.Operation `json:"patch,omitempty"`
+}
+
+// TestGCPWorkloadIdentityMutator_Handle_golden runs the cases in testdata/mutate, each of which is a directory with
+// serviceaccount.yaml, pod.yaml and optionally namespace.yaml (read with PodSecurityStandards) as the input, and response.golden.yaml and pod.golden.yaml (the Pod patched by
+// the response) as the expected output. Run with -update to regenerate the golden files after changing the mutation.
+func TestGCPWorkloadIdentityMutator_Handle_golden(t *testing.T) {
+	dirs, err := os.ReadDir(filepath.Join("testdata", "mutate"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		t.Run(dir.Name(), func(t *testing.T) {
+			path := filepath.Join("testdata", "mutate", dir.Name())
+			sa := &corev1.ServiceAccount{}
+			readYAML(t, filepath.Join(path, "serviceaccount.yaml"), sa)
+			podJSON := readYAML(t, filepath.Join(path, "pod.yaml"), &corev1.Pod{})
+			objs := []client.Object{sa}
+			if _, err := os.Stat(filepath.Join(path, "namespace.yaml")); err == nil {
+				ns := &corev1.Namespace{}
+				readYAML(t, filepath.Join(path, "namespace.yaml"), ns)
+				objs = append(objs, ns)
+			}
+
+			m := &GCPWorkloadIdentityMutator{
+				AnnotationDomain:       AnnotationDomainDefault,
+				DefaultAudience:        AudienceDefault,
+				DefaultTokenExpiration: DefaultTokenExpirationDefault,
+				MinTokenExpration:      MinTokenExprationDefault,
+				DefaultGCloudRegion:    DefaultGCloudRegionDefault,
+				GcloudImage:            GcloudImageDefault,
+				DefaultMode:            VolumeModeDefault,
+				PodSecurityStandards:   len(objs) > 1,
+				Client:                 fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(objs...).Build(),
+				decoder:                admission.NewDecoder(scheme.Scheme),
+			}
+			resp := m.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				UID:       "uid",
+				Namespace: sa.Namespace,
+				Operation: admissionv1.Create,
+				Object:    runtime.RawExtension{Raw: podJSON},
+			}})
+
+			actual := goldenResponse{Allowed: resp.Allowed, Warnings: resp.Warnings, Patch: resp.Patches}
+			if resp.Result != nil {
+				actual.Message = resp.Result.Message
+			}
+			compareGolden(t, filepath.Join(path, "response.golden.yaml"), actual)
+
+			patch, err := json.Marshal(resp.Patches)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := jsonpatchv5.DecodePatch(patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := decoded.Apply(podJSON)
+			if err != nil {
+				t.Fatalf("failed to apply the patch: %v", err)
+			}
+			var pod map[string]any
+			if err := yaml.Unmarshal(patched, &pod); err != nil {
+				t.Fatal(err)
+			}
+			compareGolden(t, filepath.Join(path, "pod.golden.yaml"), pod)
+		})
+	}
+}
+
+// readYAML decodes the YAML file into obj strictly to catch typos in the cases, and returns it in JSON
+func readYAML(t *testing.T, path string, obj any) []byte {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.UnmarshalStrict(data, obj); err != nil {
+		t.Fatalf("failed to decode %s: %v", path, err)
+	}
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// compareGolden compares actual in YAML with the golden file, or writes it with -update
+func compareGolden(t *testing.T, path string, actual any) {
+	t.Helper()
+	data, err := yaml.Marshal(actual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(string(expected), string(data)); diff != "" {
+		t.Errorf("mismatch with %s (-want +got), run with -update if it is expected:\n%s", path, diff)
+	}
+}
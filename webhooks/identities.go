@@ -0,0 +1,138 @@
+package webhooks
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+)
+
+var identityNameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// AdditionalIdentity is a named identity federated in addition to the default one of the ServiceAccount.
+// It is configured by the ServiceAccount annotations suffixed with ".{Name}",
+// e.g. "cloud.google.com/workload-identity-provider.org-b".
+type AdditionalIdentity struct {
+	Name                     string
+	WorkloadIdentityProvider string
+	ServiceAccountEmail      string
+	// Audience defaults to the webhook's default audience
+	Audience *string
+}
+
+// parseAdditionalIdentities returns the additional identities in the ServiceAccount annotations sorted by name
+func parseAdditionalIdentities(annotationDomain string, annotations map[string]string) ([]AdditionalIdentity, error) {
+	identities := map[string]*AdditionalIdentity{}
+	identity := func(name string) (*AdditionalIdentity, error) {
+		if !identityNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("identity name %q must consist of lower case alphanumeric characters or '-'", name)
+		}
+		if _, ok := identities[name]; !ok {
+			identities[name] = &AdditionalIdentity{Name: name}
+		}
+		return identities[name], nil
+	}
+	for k, v := range annotations {
+		for _, annotation := range []string{WorkloadIdentityProviderAnnotation, ServiceAccountEmailAnnotation, AudienceAnnotation} {
+			name, ok := strings.CutPrefix(k, filepath.Join(annotationDomain, annotation)+".")
+			if !ok {
+				continue
+			}
+			id, err := identity(name)
+			if err != nil {
+				return nil, err
+			}
+			switch annotation {
+			case WorkloadIdentityProviderAnnotation:
+				id.WorkloadIdentityProvider = v
+			case ServiceAccountEmailAnnotation:
+				id.ServiceAccountEmail = v
+			case AudienceAnnotation:
+				id.Audience = ptr.To(v)
+			}
+		}
+	}
+
+	var result []AdditionalIdentity
+	for name, id := range identities {
+		if id.WorkloadIdentityProvider == "" || id.ServiceAccountEmail == "" {
+			return nil, fmt.Errorf("%s.%s, %s.%s must set at a time",
+				filepath.Join(annotationDomain, WorkloadIdentityProviderAnnotation), name,
+				filepath.Join(annotationDomain, ServiceAccountEmailAnnotation), name,
+			)
+		}
+		if !workloadIdentityProviderRegex.MatchString(id.WorkloadIdentityProvider) {
+			return nil, fmt.Errorf("%s.%s must be form of %s", filepath.Join(annotationDomain, WorkloadIdentityProviderAnnotation), name, workloadIdentityProviderFmt)
+		}
+		result = append(result, *id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// identityTokenFiles returns the token file name for each additional identity. Identities with the same audience
+// share a token file, and the ones with the default identity's audience share the default token file.
+func identityTokenFiles(defaultAudience string, identities []AdditionalIdentity) map[string]string {
+	byAudience := map[string]string{defaultAudience: K8sSATokenName}
+	files := map[string]string{}
+	for _, id := range identities {
+		if _, ok := byAudience[*id.Audience]; !ok {
+			byAudience[*id.Audience] = K8sSATokenName + "-" + id.Name
+		}
+		files[id.Name] = byAudience[*id.Audience]
+	}
+	return files
+}
+
+// identityTokenProjections returns the projections of the tokens for the audiences other than the default one
+func identityTokenProjections(defaultAudience string, identities []AdditionalIdentity, expirationSeconds int64) []corev1.VolumeProjection {
+	files := identityTokenFiles(defaultAudience, identities)
+	var projections []corev1.VolumeProjection
+	for _, id := range identities {
+		if files[id.Name] != K8sSATokenName+"-"+id.Name {
+			continue
+		}
+		projections = append(projections, corev1.VolumeProjection{
+			ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+				Audience:          *id.Audience,
+				ExpirationSeconds: ptr.To(expirationSeconds),
+				Path:              files[id.Name],
+			},
+		})
+	}
+	return projections
+}
+
+// identityCredentialsVolume projects the credential configuration of each additional identity, which are rendered
+// into the Pod annotations, to "{Name}.json"
+func (m *GCPWorkloadIdentityMutator) identityCredentialsVolume(identities []AdditionalIdentity, defaultMode int32) corev1.Volume {
+	var items []corev1.DownwardAPIVolumeFile
+	for _, id := range identities {
+		items = append(items, corev1.DownwardAPIVolumeFile{
+			Path: id.Name + ".json",
+			FieldRef: &corev1.ObjectFieldSelector{
+				APIVersion: "v1",
+				FieldPath:  fmt.Sprintf("metadata.annotations['%s.%s']", filepath.Join(m.AnnotationDomain, ExternalCredentialsJsonAnnotation), id.Name),
+			},
+		})
+	}
+	return corev1.Volume{
+		Name: IdentityCredentialsVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items:       items,
+				DefaultMode: ptr.To(defaultMode),
+			},
+		},
+	}
+}
+
+var identityCredentialsVolumeMount = corev1.VolumeMount{
+	Name:      IdentityCredentialsVolumeName,
+	MountPath: IdentityCredentialsMountPath,
+	ReadOnly:  true,
+}
@@ -2,12 +2,16 @@ package webhooks
 
 import (
 	"fmt"
+	"math"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
 var (
@@ -23,14 +27,21 @@ type GCPWorkloadIdentityConfig struct {
 
 	Audience               *string
 	TokenExpirationSeconds *int64
+
+	AdditionalIdentities []AdditionalIdentity
+
+	// implicitInjectionMode is set by Resolve when InjectionMode is the webhook's default
+	implicitInjectionMode bool
 }
 
 type InjectionMode string
 
 const (
-	UndefinedMode InjectionMode = ""
-	GCloudMode    InjectionMode = "gcloud"
-	DirectMode    InjectionMode = "direct"
+	UndefinedMode   InjectionMode = ""
+	GCloudMode      InjectionMode = "gcloud"
+	DirectMode      InjectionMode = "direct"
+	MetadataMode    InjectionMode = "metadata"
+	AccessTokenMode InjectionMode = "access-token"
 )
 
 func NewGCPWorkloadIdentityConfig(
@@ -52,9 +63,9 @@ func NewGCPWorkloadIdentityConfig(
 	}
 
 	if v, ok := sa.Annotations[filepath.Join(annotationDomain, TokenExpirationAnnotation)]; ok {
-		seconds, err := strconv.ParseInt(v, 10, 64)
+		seconds, err := parseTokenExpiration(annotationDomain, v)
 		if err != nil {
-			return nil, fmt.Errorf("%s must be positive integer string: %w", filepath.Join(annotationDomain, TokenExpirationAnnotation), err)
+			return nil, err
 		}
 		cfg.TokenExpirationSeconds = &seconds
 	}
@@ -64,23 +75,33 @@ func NewGCPWorkloadIdentityConfig(
 		if err != nil {
 			return nil, fmt.Errorf("%s must be positive integer string: %w", filepath.Join(annotationDomain, RunAsUserAnnotation), err)
 		}
+		// the same range as the validation of runAsUser by the API server
+		if userId < 0 || userId > math.MaxInt32 {
+			return nil, fmt.Errorf("%s must be between 0 and %d: %q", filepath.Join(annotationDomain, RunAsUserAnnotation), math.MaxInt32, v)
+		}
 		cfg.RunAsUser = &userId
 	}
 
 	if v, ok := sa.Annotations[filepath.Join(annotationDomain, InjectionModeAnnotation)]; ok {
-		switch InjectionMode(strings.ToLower(v)) {
-		case DirectMode:
-			cfg.InjectionMode = DirectMode
-		case GCloudMode:
-			cfg.InjectionMode = GCloudMode
-		default:
-			return nil, fmt.Errorf("%s mode must be '%s', '%s' or unset", filepath.Join(annotationDomain, InjectionModeAnnotation), DirectMode, GCloudMode)
+		mode, err := parseInjectionMode(annotationDomain, v)
+		if err != nil {
+			return nil, err
 		}
+		cfg.InjectionMode = mode
 	} else {
 		cfg.InjectionMode = UndefinedMode
 	}
 
+	identities, err := parseAdditionalIdentities(annotationDomain, sa.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AdditionalIdentities = identities
+
 	if cfg.WorkloadIdentityProvider == nil && cfg.ServiceAccountEmail == nil {
+		if len(identities) > 0 {
+			return nil, fmt.Errorf("additional identities require the default identity in %s, %s", filepath.Join(annotationDomain, WorkloadIdentityProviderAnnotation), filepath.Join(annotationDomain, ServiceAccountEmailAnnotation))
+		}
 		return nil, nil
 	}
 
@@ -94,3 +115,139 @@ func NewGCPWorkloadIdentityConfig(
 
 	return cfg, nil
 }
+
+// InjectionModes are all the valid injection modes
+var InjectionModes = []InjectionMode{GCloudMode, DirectMode, MetadataMode, AccessTokenMode}
+
+// parseTokenExpiration parses the token-expiration annotation value in seconds (e.g. "3600") or
+// in Go duration (e.g. "6h") into seconds
+func parseTokenExpiration(annotationDomain, v string) (int64, error) {
+	seconds, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		d, derr := time.ParseDuration(v)
+		if derr != nil {
+			return 0, fmt.Errorf("%s must be positive integer string or duration string (e.g. 6h): %w", filepath.Join(annotationDomain, TokenExpirationAnnotation), err)
+		}
+		seconds = int64(d.Seconds())
+	}
+	if seconds <= 0 {
+		return 0, fmt.Errorf("%s must be positive integer string or duration string (e.g. 6h): %q", filepath.Join(annotationDomain, TokenExpirationAnnotation), v)
+	}
+	return seconds, nil
+}
+
+func parseInjectionMode(annotationDomain, v string) (InjectionMode, error) {
+	mode := InjectionMode(strings.ToLower(v))
+	if !slices.Contains(InjectionModes, mode) {
+		return UndefinedMode, fmt.Errorf("%s mode must be '%s', '%s', '%s', '%s' or unset", filepath.Join(annotationDomain, InjectionModeAnnotation), DirectMode, GCloudMode, MetadataMode, AccessTokenMode)
+	}
+	return mode, nil
+}
+
+// maxTokenExpirationSeconds is the maximum expirationSeconds of the projected token allowed by the API server
+const maxTokenExpirationSeconds = 1 << 32
+
+// PodOverridableAnnotations are the annotations which can be allowed to be overridden by Pods
+var PodOverridableAnnotations = []string{TokenExpirationAnnotation, AudienceAnnotation, InjectionModeAnnotation}
+
+// ResolveDefaults are the webhook's defaults used by Resolve
+type ResolveDefaults struct {
+	Audience           string
+	TokenExpiration    time.Duration
+	MinTokenExpiration time.Duration
+	// MaxTokenExpiration is the limit of the API server, 2^32 seconds, if zero
+	MaxTokenExpiration time.Duration
+	InjectionMode      InjectionMode
+	// DeprecatedInjectionModes are the modes which are warned about when resolved
+	DeprecatedInjectionModes []InjectionMode
+}
+
+// Resolve returns the effective configuration for the Pod, in which Audience, TokenExpirationSeconds and
+// InjectionMode are always set. For each of them, the precedence is:
+//
+//  1. the Pod annotation, only if the annotation is in podOverridable
+//  2. the ServiceAccount annotation
+//  3. the webhook's default
+//
+// The token expiration is raised to defaults.MinTokenExpiration, or lowered to defaults.MaxTokenExpiration,
+// after the resolution. The audiences of AdditionalIdentities default to defaults.Audience.
+// The returned warnings are meant to be shown to the user creating the Pod.
+func (c GCPWorkloadIdentityConfig) Resolve(
+	annotationDomain string,
+	pod *corev1.Pod,
+	podOverridable []string,
+	defaults ResolveDefaults,
+) (*GCPWorkloadIdentityConfig, admission.Warnings, error) {
+	var warnings admission.Warnings
+	resolved := c
+	podAnnotation := func(name string) (string, bool) {
+		if !slices.Contains(podOverridable, name) {
+			return "", false
+		}
+		v, ok := pod.Annotations[filepath.Join(annotationDomain, name)]
+		return v, ok
+	}
+
+	if v, ok := podAnnotation(AudienceAnnotation); ok {
+		resolved.Audience = &v
+	} else if resolved.Audience == nil {
+		resolved.Audience = &defaults.Audience
+	}
+
+	resolved.AdditionalIdentities = nil
+	for _, id := range c.AdditionalIdentities {
+		if id.Audience == nil {
+			id.Audience = &defaults.Audience
+		}
+		resolved.AdditionalIdentities = append(resolved.AdditionalIdentities, id)
+	}
+
+	expirationSeconds := int64(defaults.TokenExpiration.Seconds())
+	if c.TokenExpirationSeconds != nil {
+		expirationSeconds = *c.TokenExpirationSeconds
+	}
+	if v, ok := podAnnotation(TokenExpirationAnnotation); ok {
+		seconds, err := parseTokenExpiration(annotationDomain, v)
+		if err != nil {
+			return nil, nil, err
+		}
+		expirationSeconds = seconds
+	}
+	if expirationSeconds < int64(defaults.MinTokenExpiration.Seconds()) {
+		warnings = append(warnings, fmt.Sprintf("%s %d is raised to the minimum %d", filepath.Join(annotationDomain, TokenExpirationAnnotation), expirationSeconds, int64(defaults.MinTokenExpiration.Seconds())))
+		expirationSeconds = int64(defaults.MinTokenExpiration.Seconds())
+	}
+	maxExpirationSeconds := int64(defaults.MaxTokenExpiration.Seconds())
+	if maxExpirationSeconds <= 0 || maxExpirationSeconds > maxTokenExpirationSeconds {
+		maxExpirationSeconds = maxTokenExpirationSeconds
+	}
+	if expirationSeconds > maxExpirationSeconds {
+		warnings = append(warnings, fmt.Sprintf("%s %d is lowered to the maximum %d", filepath.Join(annotationDomain, TokenExpirationAnnotation), expirationSeconds, maxExpirationSeconds))
+		expirationSeconds = maxExpirationSeconds
+	}
+	resolved.TokenExpirationSeconds = &expirationSeconds
+
+	if v, ok := podAnnotation(InjectionModeAnnotation); ok {
+		mode, err := parseInjectionMode(annotationDomain, v)
+		if err != nil {
+			return nil, nil, err
+		}
+		resolved.InjectionMode = mode
+	}
+	if resolved.InjectionMode == UndefinedMode {
+		resolved.InjectionMode = defaults.InjectionMode
+		if resolved.InjectionMode == UndefinedMode {
+			resolved.InjectionMode = GCloudMode
+		}
+		resolved.implicitInjectionMode = true
+		warnings = append(warnings, fmt.Sprintf(
+			"ServiceAccount %q has no %s annotation, defaulting to '%s' which may change in the future",
+			pod.Spec.ServiceAccountName, filepath.Join(annotationDomain, InjectionModeAnnotation), resolved.InjectionMode,
+		))
+	}
+	if slices.Contains(defaults.DeprecatedInjectionModes, resolved.InjectionMode) {
+		warnings = append(warnings, fmt.Sprintf("%s mode '%s' is deprecated in this cluster", filepath.Join(annotationDomain, InjectionModeAnnotation), resolved.InjectionMode))
+	}
+
+	return &resolved, warnings, nil
+}
@@ -2,12 +2,15 @@ package webhooks
 
 import (
 	"fmt"
+	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/ptr"
 )
 
 var _ = Describe("NewGCPWorkloadIdentityConfig", func() {
@@ -119,6 +122,71 @@ var _ = Describe("NewGCPWorkloadIdentityConfig", func() {
 				}))
 			})
 		})
+		When("ServiceAccount with token-expiration annotation in duration string", func() {
+			It("can create GCPWorkloadIdentityConfig", func() {
+				sa := corev1.ServiceAccount{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							idProviderAnnotation:      workloadProvider,
+							saEmailAnnotation:         saEmail,
+							tokenExpirationAnnotation: "6h",
+						},
+					},
+				}
+				idConfig, err := NewGCPWorkloadIdentityConfig(annotaitonDomain, sa)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(idConfig.TokenExpirationSeconds).To(HaveValue(BeEquivalentTo(6 * 3600)))
+			})
+		})
+		When("ServiceAccount with additional identities", func() {
+			It("can create GCPWorkloadIdentityConfig", func() {
+				sa := corev1.ServiceAccount{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							idProviderAnnotation:            workloadProvider,
+							saEmailAnnotation:               saEmail,
+							idProviderAnnotation + ".org-b": workloadProvider,
+							saEmailAnnotation + ".org-b":    "sa@org-b.iam.gserviceaccount.com",
+							audienceAnnotation + ".org-b":   "org-b",
+							idProviderAnnotation + ".org-a": workloadProvider,
+							saEmailAnnotation + ".org-a":    "sa@org-a.iam.gserviceaccount.com",
+						},
+					},
+				}
+				idConfig, err := NewGCPWorkloadIdentityConfig(annotaitonDomain, sa)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(idConfig.AdditionalIdentities).To(Equal([]AdditionalIdentity{{
+					Name:                     "org-a",
+					WorkloadIdentityProvider: workloadProvider,
+					ServiceAccountEmail:      "sa@org-a.iam.gserviceaccount.com",
+				}, {
+					Name:                     "org-b",
+					WorkloadIdentityProvider: workloadProvider,
+					ServiceAccountEmail:      "sa@org-b.iam.gserviceaccount.com",
+					Audience:                 ptr.To("org-b"),
+				}}))
+			})
+		})
+		When("ServiceAccount with 'metadata' injection mode annotation", func() {
+			It("can create GCPWorkloadIdentityConfig", func() {
+				sa := corev1.ServiceAccount{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							idProviderAnnotation:    workloadProvider,
+							saEmailAnnotation:       saEmail,
+							injectionModeAnnotation: string(MetadataMode),
+						},
+					},
+				}
+				idConfig, err := NewGCPWorkloadIdentityConfig(annotaitonDomain, sa)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(idConfig).To(BeEquivalentTo(&GCPWorkloadIdentityConfig{
+					WorkloadIdentityProvider: &workloadProvider,
+					ServiceAccountEmail:      &saEmail,
+					InjectionMode:            MetadataMode,
+				}))
+			})
+		})
 	})
 	Describe("Failure Case", func() {
 		var sa corev1.ServiceAccount
@@ -182,6 +250,79 @@ var _ = Describe("NewGCPWorkloadIdentityConfig", func() {
 				Expect(err).To(MatchError(ContainSubstring("must be positive integer string")))
 			})
 		})
+		When("ServiceAccount with non-positive token-expiration annotation", func() {
+			It("should raise error", func() {
+				for _, v := range []string{"0", "-3600", "-1h", "100ms"} {
+					sa = corev1.ServiceAccount{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								idProviderAnnotation:      workloadProvider,
+								saEmailAnnotation:         saEmail,
+								tokenExpirationAnnotation: v,
+							},
+						},
+					}
+					idConfig, err = NewGCPWorkloadIdentityConfig(annotaitonDomain, sa)
+					Expect(idConfig).To(BeNil(), v)
+					Expect(err).To(MatchError(ContainSubstring("must be positive")), v)
+				}
+			})
+		})
+		When("ServiceAccount with out of range gcloud-run-as-user annotation", func() {
+			It("should raise error", func() {
+				for _, v := range []string{"-1", "2147483648"} {
+					sa = corev1.ServiceAccount{
+						ObjectMeta: metav1.ObjectMeta{
+							Annotations: map[string]string{
+								idProviderAnnotation: workloadProvider,
+								saEmailAnnotation:    saEmail,
+								filepath.Join(annotaitonDomain, RunAsUserAnnotation): v,
+							},
+						},
+					}
+					idConfig, err = NewGCPWorkloadIdentityConfig(annotaitonDomain, sa)
+					Expect(idConfig).To(BeNil(), v)
+					Expect(err).To(MatchError(ContainSubstring("must be between 0 and 2147483647")), v)
+				}
+			})
+		})
+		When("ServiceAccount with malformed additional identities", func() {
+			It("should raise error", func() {
+				By("without service-account-email annotation of the identity")
+				sa = corev1.ServiceAccount{
+					ObjectMeta: metav1.ObjectMeta{
+						Annotations: map[string]string{
+							idProviderAnnotation:            workloadProvider,
+							saEmailAnnotation:               saEmail,
+							idProviderAnnotation + ".org-b": workloadProvider,
+						},
+					},
+				}
+				idConfig, err = NewGCPWorkloadIdentityConfig(annotaitonDomain, sa)
+				Expect(idConfig).To(BeNil())
+				Expect(err).To(MatchError(ContainSubstring("must set at a time")))
+
+				By("with invalid identity name")
+				sa.Annotations = map[string]string{
+					idProviderAnnotation:            workloadProvider,
+					saEmailAnnotation:               saEmail,
+					idProviderAnnotation + ".Org_B": workloadProvider,
+					saEmailAnnotation + ".Org_B":    saEmail,
+				}
+				idConfig, err = NewGCPWorkloadIdentityConfig(annotaitonDomain, sa)
+				Expect(idConfig).To(BeNil())
+				Expect(err).To(MatchError(ContainSubstring("must consist of lower case alphanumeric characters")))
+
+				By("without the default identity")
+				sa.Annotations = map[string]string{
+					idProviderAnnotation + ".org-b": workloadProvider,
+					saEmailAnnotation + ".org-b":    saEmail,
+				}
+				idConfig, err = NewGCPWorkloadIdentityConfig(annotaitonDomain, sa)
+				Expect(idConfig).To(BeNil())
+				Expect(err).To(MatchError(ContainSubstring("require the default identity")))
+			})
+		})
 		When("ServiceAccount with unparsable injection mode annotation", func() {
 			It("should raise error", func() {
 				sa = corev1.ServiceAccount{
@@ -200,3 +341,183 @@ var _ = Describe("NewGCPWorkloadIdentityConfig", func() {
 		})
 	})
 })
+
+var _ = Describe("GCPWorkloadIdentityConfig.Resolve", func() {
+	workloadProvider := `projects/{PROJECT_NUMBER}/locations/{LOCATION}/workloadIdentityPools/{POOL_ID}/providers/{PROVIDER_ID}`
+	saEmail := `sa@project.iam.gserviceaccount.com`
+	allOverridable := PodOverridableAnnotations
+
+	var idConfig GCPWorkloadIdentityConfig
+	BeforeEach(func() {
+		idConfig = GCPWorkloadIdentityConfig{
+			WorkloadIdentityProvider: &workloadProvider,
+			ServiceAccountEmail:      &saEmail,
+		}
+	})
+	resolve := func(pod *corev1.Pod, overridable []string) (*GCPWorkloadIdentityConfig, error) {
+		resolved, _, err := idConfig.Resolve(annotaitonDomain, pod, overridable, ResolveDefaults{
+			Audience:           AudienceDefault,
+			TokenExpiration:    DefaultTokenExpirationDefault,
+			MinTokenExpiration: MinTokenExprationDefault,
+		})
+		return resolved, err
+	}
+
+	When("neither ServiceAccount nor Pod has annotations", func() {
+		It("should use the webhook defaults", func() {
+			resolved, err := resolve(&corev1.Pod{}, allOverridable)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Audience).To(HaveValue(Equal(AudienceDefault)))
+			Expect(resolved.TokenExpirationSeconds).To(HaveValue(BeEquivalentTo(DefaultTokenExpirationDefault.Seconds())))
+			Expect(resolved.InjectionMode).To(Equal(GCloudMode))
+		})
+	})
+	When("both ServiceAccount and Pod have annotations", func() {
+		var pod *corev1.Pod
+		BeforeEach(func() {
+			idConfig.Audience = ptr.To("sa-audience")
+			idConfig.TokenExpirationSeconds = ptr.To[int64](7200)
+			idConfig.InjectionMode = DirectMode
+			pod = &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						audienceAnnotation:        "pod-audience",
+						tokenExpirationAnnotation: "10800",
+						injectionModeAnnotation:   string(GCloudMode),
+					},
+				},
+			}
+		})
+		It("should prefer the Pod annotations which are overridable", func() {
+			resolved, err := resolve(pod, allOverridable)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Audience).To(HaveValue(Equal("pod-audience")))
+			Expect(resolved.TokenExpirationSeconds).To(HaveValue(BeEquivalentTo(10800)))
+			Expect(resolved.InjectionMode).To(Equal(GCloudMode))
+		})
+		It("should ignore the Pod annotations which are not overridable", func() {
+			resolved, err := resolve(pod, []string{InjectionModeAnnotation})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.Audience).To(HaveValue(Equal("sa-audience")))
+			Expect(resolved.TokenExpirationSeconds).To(HaveValue(BeEquivalentTo(7200)))
+			Expect(resolved.InjectionMode).To(Equal(GCloudMode))
+		})
+		It("should not modify the receiver", func() {
+			_, err := resolve(pod, allOverridable)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(idConfig.Audience).To(HaveValue(Equal("sa-audience")))
+			Expect(idConfig.InjectionMode).To(Equal(DirectMode))
+		})
+	})
+	When("the token expiration is shorter than the minimum", func() {
+		It("should raise it to the minimum and warn", func() {
+			idConfig.TokenExpirationSeconds = ptr.To[int64](60)
+			resolved, warnings, err := idConfig.Resolve(annotaitonDomain, &corev1.Pod{}, allOverridable, ResolveDefaults{
+				Audience:           AudienceDefault,
+				TokenExpiration:    DefaultTokenExpirationDefault,
+				MinTokenExpiration: MinTokenExprationDefault,
+				InjectionMode:      GCloudMode,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.TokenExpirationSeconds).To(HaveValue(BeEquivalentTo(MinTokenExprationDefault.Seconds())))
+			Expect(warnings).To(ContainElement(ContainSubstring("is raised to the minimum")))
+		})
+	})
+	When("the token expiration is longer than the maximum", func() {
+		It("should lower it to the maximum and warn", func() {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						tokenExpirationAnnotation: "48h",
+					},
+				},
+			}
+			resolved, warnings, err := idConfig.Resolve(annotaitonDomain, pod, allOverridable, ResolveDefaults{
+				Audience:           AudienceDefault,
+				TokenExpiration:    DefaultTokenExpirationDefault,
+				MinTokenExpiration: MinTokenExprationDefault,
+				MaxTokenExpiration: 12 * time.Hour,
+				InjectionMode:      GCloudMode,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.TokenExpirationSeconds).To(HaveValue(BeEquivalentTo(12 * 3600)))
+			Expect(warnings).To(ContainElement(ContainSubstring("172800 is lowered to the maximum 43200")))
+		})
+	})
+	When("the token expiration is longer than the API server allows", func() {
+		It("should lower it to the limit and warn without the maximum", func() {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						tokenExpirationAnnotation: "5000000000",
+					},
+				},
+			}
+			resolved, warnings, err := idConfig.Resolve(annotaitonDomain, pod, allOverridable, ResolveDefaults{
+				Audience:           AudienceDefault,
+				TokenExpiration:    DefaultTokenExpirationDefault,
+				MinTokenExpiration: MinTokenExprationDefault,
+				InjectionMode:      GCloudMode,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.TokenExpirationSeconds).To(HaveValue(BeEquivalentTo(1 << 32)))
+			Expect(warnings).To(ContainElement(ContainSubstring("5000000000 is lowered to the maximum 4294967296")))
+		})
+	})
+	When("the Pod has non-positive token expiration", func() {
+		It("should raise error", func() {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						tokenExpirationAnnotation: "-1",
+					},
+				},
+			}
+			_, err := resolve(pod, allOverridable)
+			Expect(err).To(MatchError(ContainSubstring("must be positive")))
+		})
+	})
+	When("ServiceAccount relies on the default injection mode", func() {
+		It("should use the configured default and warn", func() {
+			pod := &corev1.Pod{Spec: corev1.PodSpec{ServiceAccountName: "app"}}
+			resolved, warnings, err := idConfig.Resolve(annotaitonDomain, pod, nil, ResolveDefaults{InjectionMode: DirectMode})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.InjectionMode).To(Equal(DirectMode))
+			Expect(resolved.implicitInjectionMode).To(BeTrue())
+			Expect(warnings).To(ConsistOf(ContainSubstring(`ServiceAccount "app" has no cloud.google.com/injection-mode annotation, defaulting to 'direct'`)))
+		})
+		It("should not warn when the Pod overrides it", func() {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{injectionModeAnnotation: string(GCloudMode)},
+				},
+			}
+			resolved, warnings, err := idConfig.Resolve(annotaitonDomain, pod, allOverridable, ResolveDefaults{InjectionMode: DirectMode})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resolved.InjectionMode).To(Equal(GCloudMode))
+			Expect(resolved.implicitInjectionMode).To(BeFalse())
+			Expect(warnings).To(BeEmpty())
+		})
+	})
+	When("the resolved injection mode is deprecated", func() {
+		It("should warn", func() {
+			idConfig.InjectionMode = GCloudMode
+			_, warnings, err := idConfig.Resolve(annotaitonDomain, &corev1.Pod{}, nil, ResolveDefaults{
+				DeprecatedInjectionModes: []InjectionMode{GCloudMode},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ConsistOf(ContainSubstring("mode 'gcloud' is deprecated")))
+		})
+	})
+	When("Pod has an invalid injection mode annotation", func() {
+		It("should raise error", func() {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{injectionModeAnnotation: "not-valid"},
+				},
+			}
+			_, err := resolve(pod, allOverridable)
+			Expect(err).To(MatchError(ContainSubstring("mode must be")))
+		})
+	})
+})
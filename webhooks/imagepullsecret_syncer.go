@@ -0,0 +1,169 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// ImagePullSecretSyncer copies the image pull secrets for the gcloud image from SourceNamespace
+// into every other namespace so that the injected gcloud-setup init container can pull the image
+// regardless of the secrets attached to the Pod's ServiceAccount.
+//
+// It is optional and requires get/list/watch on namespaces and get/list/watch/create/update on secrets, which the
+// helm chart grants only with gcloudImagePullSecrets.sync.
+// The manager must cache Secrets as configured by ImagePullSecretCacheByObject.
+type ImagePullSecretSyncer struct {
+	SourceNamespace string
+	SecretNames     []string
+	// TargetNamespaces restricts the namespaces to copy the secrets into. All namespaces if empty.
+	TargetNamespaces []string
+	// AnnotationDomain is the prefix of the annotation recording the source of the copied secrets
+	AnnotationDomain string
+
+	client.Client
+}
+
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update
+
+// Reconcile implements reconcile.Reconciler. The request name is the name of the target namespace.
+func (s *ImagePullSecretSyncer) Reconcile(ctx context.Context, req reconcile.Request) (reconcile.Result, error) {
+	logger := log.FromContext(ctx)
+
+	if req.Name == s.SourceNamespace || !s.isTarget(req.Name) {
+		return reconcile.Result{}, nil
+	}
+
+	ns := corev1.Namespace{}
+	if err := s.Get(ctx, types.NamespacedName{Name: req.Name}, &ns); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if !ns.DeletionTimestamp.IsZero() {
+		return reconcile.Result{}, nil
+	}
+
+	for _, name := range s.SecretNames {
+		src := corev1.Secret{}
+		if err := s.Get(ctx, types.NamespacedName{Namespace: s.SourceNamespace, Name: name}, &src); err != nil {
+			if apierrors.IsNotFound(err) {
+				logger.Info("Skip syncing because the source secret is not found", "Secret", s.SourceNamespace+"/"+name)
+				continue
+			}
+			return reconcile.Result{}, err
+		}
+
+		dst := corev1.Secret{}
+		err := s.Get(ctx, types.NamespacedName{Namespace: ns.Name, Name: name}, &dst)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return reconcile.Result{}, err
+		}
+		if err == nil && dst.Labels[ImagePullSecretManagedByLabel] != ImagePullSecretManagedByValue {
+			logger.Info("Skip syncing because an unmanaged secret with the same name exists", "Secret", ns.Name+"/"+name)
+			continue
+		}
+
+		dst = corev1.Secret{}
+		dst.Namespace = ns.Name
+		dst.Name = name
+		if _, err := controllerutil.CreateOrUpdate(ctx, s.Client, &dst, func() error {
+			if dst.Labels == nil {
+				dst.Labels = map[string]string{}
+			}
+			dst.Labels[ImagePullSecretManagedByLabel] = ImagePullSecretManagedByValue
+			if dst.Annotations == nil {
+				dst.Annotations = map[string]string{}
+			}
+			dst.Annotations[filepath.Join(s.AnnotationDomain, ImagePullSecretSourceAnnotation)] = s.SourceNamespace + "/" + name
+			dst.Type = src.Type
+			dst.Data = src.Data
+			return nil
+		}); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				// the unmanaged secrets are out of the cache
+				logger.Info("Skip syncing because an unmanaged secret with the same name exists", "Secret", ns.Name+"/"+name)
+				continue
+			}
+			return reconcile.Result{}, fmt.Errorf("failed to sync secret %s/%s: %w", ns.Name, name, err)
+		}
+	}
+
+	return reconcile.Result{}, nil
+}
+
+// ImagePullSecretCacheByObject returns the cache configuration of the Secrets for the manager running
+// ImagePullSecretSyncer, which caches all the Secrets in the source namespace but only the copied ones in the
+// target namespaces (all namespaces if empty) instead of every Secret in the cluster.
+func ImagePullSecretCacheByObject(sourceNamespace string, targetNamespaces []string) (client.Object, cache.ByObject) {
+	managed := cache.Config{
+		LabelSelector: labels.SelectorFromSet(labels.Set{ImagePullSecretManagedByLabel: ImagePullSecretManagedByValue}),
+	}
+	byObject := cache.ByObject{
+		Namespaces: map[string]cache.Config{},
+		Transform:  cache.TransformStripManagedFields(),
+	}
+	if len(targetNamespaces) == 0 {
+		byObject.Namespaces[cache.AllNamespaces] = managed
+	}
+	for _, ns := range targetNamespaces {
+		byObject.Namespaces[ns] = managed
+	}
+	byObject.Namespaces[sourceNamespace] = cache.Config{LabelSelector: labels.Everything()}
+	return &corev1.Secret{}, byObject
+}
+
+func (s *ImagePullSecretSyncer) SetupWithManager(mgr ctrl.Manager) error {
+	if s.SourceNamespace == "" {
+		return fmt.Errorf("source namespace of image pull secrets must be set")
+	}
+	s.Client = mgr.GetClient()
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("image-pull-secret-syncer").
+		For(&corev1.Namespace{}).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(s.secretToNamespaces)).
+		Complete(s)
+}
+
+// secretToNamespaces maps a change of a source secret to all namespaces, and a change of a copied
+// secret to its own namespace so that manual edits and deletions are reverted.
+func (s *ImagePullSecretSyncer) secretToNamespaces(ctx context.Context, obj client.Object) []reconcile.Request {
+	if !slices.Contains(s.SecretNames, obj.GetName()) {
+		return nil
+	}
+
+	if obj.GetNamespace() != s.SourceNamespace {
+		return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: obj.GetNamespace()}}}
+	}
+
+	nsList := corev1.NamespaceList{}
+	if err := s.List(ctx, &nsList); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list namespaces")
+		return nil
+	}
+	reqs := make([]reconcile.Request, 0, len(nsList.Items))
+	for _, ns := range nsList.Items {
+		if !s.isTarget(ns.Name) {
+			continue
+		}
+		reqs = append(reqs, reconcile.Request{NamespacedName: types.NamespacedName{Name: ns.Name}})
+	}
+	return reqs
+}
+
+func (s *ImagePullSecretSyncer) isTarget(namespace string) bool {
+	return len(s.TargetNamespaces) == 0 || slices.Contains(s.TargetNamespaces, namespace)
+}
@@ -0,0 +1,146 @@
+package webhooks
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func TestImagePullSecretSyncer_Reconcile(t *testing.T) {
+	const sourceNamespace = "webhook-system"
+	src := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: sourceNamespace, Name: "gcloud-pull"},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+	}
+	namespaces := []*corev1.Namespace{
+		{ObjectMeta: metav1.ObjectMeta{Name: sourceNamespace}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "tenant-a"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "tenant-b"}},
+	}
+
+	t.Run("copies the source secret into the target namespace", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(src.DeepCopy(), namespaces[0], namespaces[1]).Build()
+		s := &ImagePullSecretSyncer{SourceNamespace: sourceNamespace, SecretNames: []string{"gcloud-pull", "missing"}, AnnotationDomain: AnnotationDomainDefault, Client: c}
+
+		if _, err := s.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "tenant-a"}}); err != nil {
+			t.Fatalf("Reconcile() returned unexpected error: %v", err)
+		}
+
+		actual := corev1.Secret{}
+		if err := c.Get(context.Background(), types.NamespacedName{Namespace: "tenant-a", Name: "gcloud-pull"}, &actual); err != nil {
+			t.Fatalf("copied secret is not found: %v", err)
+		}
+		if diff := cmp.Diff(src.Data, actual.Data); diff != "" {
+			t.Errorf("copied secret data mismatch (-want +got):\n%s", diff)
+		}
+		if actual.Type != src.Type {
+			t.Errorf("copied secret type = %v, want %v", actual.Type, src.Type)
+		}
+		if actual.Labels[ImagePullSecretManagedByLabel] != ImagePullSecretManagedByValue {
+			t.Errorf("copied secret is not labeled as managed: %v", actual.Labels)
+		}
+		if source := actual.Annotations[AnnotationDomainDefault+"/"+ImagePullSecretSourceAnnotation]; source != sourceNamespace+"/gcloud-pull" {
+			t.Errorf("copied secret is annotated with the source %q, want %q", source, sourceNamespace+"/gcloud-pull")
+		}
+	})
+
+	t.Run("does not overwrite an unmanaged secret", func(t *testing.T) {
+		unmanaged := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-b", Name: "gcloud-pull"},
+			Data:       map[string][]byte{"owned": []byte("by-user")},
+		}
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(src.DeepCopy(), namespaces[0], namespaces[2], unmanaged).Build()
+		s := &ImagePullSecretSyncer{SourceNamespace: sourceNamespace, SecretNames: []string{"gcloud-pull"}, Client: c}
+
+		if _, err := s.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "tenant-b"}}); err != nil {
+			t.Fatalf("Reconcile() returned unexpected error: %v", err)
+		}
+
+		actual := corev1.Secret{}
+		if err := c.Get(context.Background(), types.NamespacedName{Namespace: "tenant-b", Name: "gcloud-pull"}, &actual); err != nil {
+			t.Fatalf("secret is not found: %v", err)
+		}
+		if diff := cmp.Diff(unmanaged.Data, actual.Data); diff != "" {
+			t.Errorf("unmanaged secret was modified (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("does not overwrite an unmanaged secret out of the cache", func(t *testing.T) {
+		unmanaged := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-b", Name: "gcloud-pull"},
+			Data:       map[string][]byte{"owned": []byte("by-user")},
+		}
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(src.DeepCopy(), namespaces[0], namespaces[2], unmanaged).
+			WithInterceptorFuncs(interceptor.Funcs{
+				// the cache configured by ImagePullSecretCacheByObject has only the managed secrets in the target namespaces
+				Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+					if key.Namespace == "tenant-b" {
+						return apierrors.NewNotFound(corev1.Resource("secrets"), key.Name)
+					}
+					return c.Get(ctx, key, obj, opts...)
+				},
+			}).Build()
+		s := &ImagePullSecretSyncer{SourceNamespace: sourceNamespace, SecretNames: []string{"gcloud-pull"}, Client: c}
+
+		if _, err := s.Reconcile(context.Background(), reconcile.Request{NamespacedName: types.NamespacedName{Name: "tenant-b"}}); err != nil {
+			t.Fatalf("Reconcile() returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("maps a source secret change to all namespaces", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(namespaces[0], namespaces[1], namespaces[2]).Build()
+		s := &ImagePullSecretSyncer{SourceNamespace: sourceNamespace, SecretNames: []string{"gcloud-pull"}, Client: c}
+
+		if reqs := s.secretToNamespaces(context.Background(), src); len(reqs) != len(namespaces) {
+			t.Errorf("secretToNamespaces() returned %d requests, want %d", len(reqs), len(namespaces))
+		}
+		other := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Namespace: sourceNamespace, Name: "unrelated"}}
+		if reqs := s.secretToNamespaces(context.Background(), other); len(reqs) != 0 {
+			t.Errorf("secretToNamespaces() returned %d requests for an unrelated secret, want 0", len(reqs))
+		}
+	})
+
+	t.Run("maps a source secret change only to the target namespaces", func(t *testing.T) {
+		c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(namespaces[0], namespaces[1], namespaces[2]).Build()
+		s := &ImagePullSecretSyncer{SourceNamespace: sourceNamespace, SecretNames: []string{"gcloud-pull"}, TargetNamespaces: []string{"tenant-a"}, Client: c}
+
+		reqs := s.secretToNamespaces(context.Background(), src)
+		if len(reqs) != 1 || reqs[0].Name != "tenant-a" {
+			t.Errorf("secretToNamespaces() = %v, want only tenant-a", reqs)
+		}
+	})
+}
+
+func TestImagePullSecretCacheByObject(t *testing.T) {
+	managed := labels.Set{ImagePullSecretManagedByLabel: ImagePullSecretManagedByValue}
+
+	_, byObject := ImagePullSecretCacheByObject("webhook-system", nil)
+	if !byObject.Namespaces["webhook-system"].LabelSelector.Empty() {
+		t.Errorf("the source namespace is cached with the selector %v, want all the secrets", byObject.Namespaces["webhook-system"].LabelSelector)
+	}
+	all, ok := byObject.Namespaces[cache.AllNamespaces]
+	if !ok || all.LabelSelector.Matches(labels.Set{}) || !all.LabelSelector.Matches(managed) {
+		t.Errorf("the other namespaces are cached with %v, want only the managed secrets", all)
+	}
+
+	_, byObject = ImagePullSecretCacheByObject("webhook-system", []string{"tenant-a"})
+	if _, ok := byObject.Namespaces[cache.AllNamespaces]; ok {
+		t.Errorf("all namespaces are cached despite the target namespaces")
+	}
+	if selector := byObject.Namespaces["tenant-a"].LabelSelector; selector == nil || !selector.Matches(managed) || selector.Matches(labels.Set{}) {
+		t.Errorf("the target namespace is cached with %v, want only the managed secrets", selector)
+	}
+}
@@ -0,0 +1,58 @@
+package webhooks
+
+import (
+	"fmt"
+	"strings"
+
+	"gomodules.xyz/jsonpatch/v2"
+)
+
+// podPatch collects the JSON patch operations in the order mutatePod applies the changes, so that the patch touches
+// only the fields set by the webhook unlike the diff of the whole marshaled Pod. WorkloadPreviewAnnotator uses it
+// for the annotations of the workloads too.
+type podPatch struct {
+	ops []jsonpatch.JsonPatchOperation
+}
+
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// pathOf returns the JSON pointer of the key in the object at path
+func pathOf(path, key string) string {
+	return path + "/" + jsonPointerEscaper.Replace(key)
+}
+
+// indexOf returns the JSON pointer of the i-th element of the list at path
+func indexOf(path string, i int) string {
+	return fmt.Sprintf("%s/%d", path, i)
+}
+
+func (p *podPatch) add(path string, value any) {
+	p.ops = append(p.ops, jsonpatch.NewOperation("add", path, value))
+}
+
+func (p *podPatch) replace(path string, value any) {
+	p.ops = append(p.ops, jsonpatch.NewOperation("replace", path, value))
+}
+
+func (p *podPatch) remove(path string) {
+	p.ops = append(p.ops, jsonpatch.NewOperation("remove", path, nil))
+}
+
+// append adds the value to the end of the list at path with the length, or the list itself if it is empty
+// because it may be missing or null in the original object
+func (p *podPatch) append(path string, length int, value any) {
+	if length == 0 {
+		p.add(path, []any{value})
+		return
+	}
+	p.add(path+"/-", value)
+}
+
+// setAnnotation sets the annotation of the Pod unless it already has the value
+func (p *podPatch) setAnnotation(annotations map[string]string, key, value string) {
+	if v, ok := annotations[key]; ok && v == value {
+		return
+	}
+	annotations[key] = value
+	p.add(pathOf("/metadata/annotations", key), value)
+}
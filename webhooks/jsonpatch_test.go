@@ -0,0 +1,168 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newPatchTestMutator() *GCPWorkloadIdentityMutator {
+	return &GCPWorkloadIdentityMutator{
+		AnnotationDomain:       AnnotationDomainDefault,
+		DefaultAudience:        AudienceDefault,
+		DefaultTokenExpiration: DefaultTokenExpirationDefault,
+		MinTokenExpration:      MinTokenExprationDefault,
+		DefaultGCloudRegion:    DefaultGCloudRegionDefault,
+		GcloudImage:            GcloudImageDefault,
+		SidecarImage:           "ghcr.io/pfnet-research/gcp-workload-identity-federation-webhook",
+		DefaultMode:            VolumeModeDefault,
+	}
+}
+
+func patchTestIdentity(mode InjectionMode) GCPWorkloadIdentityConfig {
+	return GCPWorkloadIdentityConfig{
+		WorkloadIdentityProvider: ptr.To("projects/123/locations/global/workloadIdentityPools/pool/providers/provider"),
+		ServiceAccountEmail:      ptr.To("app@project.iam.gserviceaccount.com"),
+		RunAsUser:                ptr.To[int64](1000),
+		InjectionMode:            mode,
+	}
+}
+
+func TestGCPWorkloadIdentityMutator_mutatePod_patch(t *testing.T) {
+	tests := []struct {
+		name   string
+		pod    string
+		mode   InjectionMode
+		mutate func(m *GCPWorkloadIdentityMutator)
+	}{
+		{name: "gcloud", pod: "pod.json", mode: GCloudMode},
+		{name: "gcloud-image-pull-secrets", pod: "pod.json", mode: GCloudMode, mutate: func(m *GCPWorkloadIdentityMutator) {
+			m.GcloudImagePullSecrets = []corev1.LocalObjectReference{{Name: "gcloud-pull"}}
+		}},
+		{name: "direct", pod: "pod.json", mode: DirectMode},
+		{name: "metadata", pod: "pod.json", mode: MetadataMode},
+		{name: "access-token", pod: "pod.json", mode: AccessTokenMode},
+		{name: "conflicts", pod: "pod-conflicts.json", mode: GCloudMode},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newPatchTestMutator()
+			if tt.mutate != nil {
+				tt.mutate(m)
+			}
+			raw, err := os.ReadFile(filepath.Join("testdata", "patch", tt.pod))
+			if err != nil {
+				t.Fatal(err)
+			}
+			pod := &corev1.Pod{}
+			if err := json.Unmarshal(raw, pod); err != nil {
+				t.Fatal(err)
+			}
+
+			patches, _, err := m.mutatePod(pod, patchTestIdentity(tt.mode), podSecurity{}, nil)
+			if err != nil {
+				t.Fatalf("mutatePod() returned unexpected error: %v", err)
+			}
+			patch, err := json.MarshalIndent(patches, "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			golden := filepath.Join("testdata", "patch", tt.name+".golden.json")
+			if *update {
+				if err := os.WriteFile(golden, append(patch, '\n'), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(string(expected), string(patch)+"\n"); diff != "" {
+				t.Errorf("patch mismatch with %s (-want +got), run with -update if it is expected:\n%s", golden, diff)
+			}
+
+			// the patch must bring the original Pod to the mutated one
+			decoded, err := jsonpatch.DecodePatch(patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patched, err := decoded.Apply(raw)
+			if err != nil {
+				t.Fatalf("failed to apply the patch: %v", err)
+			}
+			actual := &corev1.Pod{}
+			if err := json.Unmarshal(patched, actual); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(pod, actual); diff != "" {
+				t.Errorf("patched Pod mismatch with the mutated one (-want +got):\n%s", diff)
+			}
+
+			// the mutation is idempotent
+			patches, _, err = m.mutatePod(actual, patchTestIdentity(tt.mode), podSecurity{}, nil)
+			if err != nil {
+				t.Fatalf("mutatePod() returned unexpected error for the mutated Pod: %v", err)
+			}
+			if len(patches) > 0 {
+				t.Errorf("mutatePod() returned the patch for the mutated Pod: %v", patches)
+			}
+		})
+	}
+}
+
+// BenchmarkGCPWorkloadIdentityMutator_mutatePod_patch compares the patch built by mutatePod with the diff of the
+// whole marshaled Pod by admission.PatchResponseFromRaw
+func BenchmarkGCPWorkloadIdentityMutator_mutatePod_patch(b *testing.B) {
+	m := newPatchTestMutator()
+	pod := &corev1.Pod{Spec: corev1.PodSpec{ServiceAccountName: "app"}}
+	for i := range 20 {
+		ctr := corev1.Container{Name: fmt.Sprintf("app-%d", i), Image: "app"}
+		for j := range 50 {
+			ctr.Env = append(ctr.Env, corev1.EnvVar{Name: fmt.Sprintf("ENV_%d", j), Value: "value"})
+			ctr.VolumeMounts = append(ctr.VolumeMounts, corev1.VolumeMount{Name: fmt.Sprintf("data-%d", j), MountPath: fmt.Sprintf("/data/%d", j)})
+		}
+		pod.Spec.Containers = append(pod.Spec.Containers, ctr)
+	}
+	for j := range 50 {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: fmt.Sprintf("data-%d", j), VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}})
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("mutatePod", func(b *testing.B) {
+		for b.Loop() {
+			patches, _, err := m.mutatePod(pod.DeepCopy(), patchTestIdentity(GCloudMode), podSecurity{}, nil)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := json.Marshal(admission.Patched("", patches...).Patches); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("PatchResponseFromRaw", func(b *testing.B) {
+		for b.Loop() {
+			mutated := pod.DeepCopy()
+			if _, _, err := m.mutatePod(mutated, patchTestIdentity(GCloudMode), podSecurity{}, nil); err != nil {
+				b.Fatal(err)
+			}
+			marshaled, err := json.Marshal(mutated)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := json.Marshal(admission.PatchResponseFromRaw(raw, marshaled).Patches); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
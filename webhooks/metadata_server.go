@@ -0,0 +1,128 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+const (
+	metadataFlavorHeader = "Metadata-Flavor"
+	metadataFlavorValue  = "Google"
+
+	metadataServiceAccountsPath = "/computeMetadata/v1/instance/service-accounts/"
+	metadataProjectIDPath       = "/computeMetadata/v1/project/project-id"
+)
+
+// MetadataServer emulates the subset of the GCE metadata server used by client libraries to acquire
+// credentials, backed by a TokenSource (typically ExternalAccountTokenSource wrapped by CachingTokenSource).
+type MetadataServer struct {
+	TokenSource         TokenSource
+	ServiceAccountEmail string
+	ProjectID           string
+
+	Logger logr.Logger
+}
+
+type metadataTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+type metadataServiceAccountResponse struct {
+	Aliases []string `json:"aliases"`
+	Email   string   `json:"email"`
+	Scopes  []string `json:"scopes"`
+}
+
+// ServeHTTP implements http.Handler
+func (s *MetadataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(metadataFlavorHeader, metadataFlavorValue)
+	w.Header().Set("Server", "Metadata Server for VM")
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	// the same protection as the real metadata server against SSRF
+	if r.URL.Path != "/" && r.Header.Get(metadataFlavorHeader) != metadataFlavorValue {
+		http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/":
+		// used by client libraries to detect the metadata server
+		_, _ = fmt.Fprintln(w, "computeMetadata/")
+	case r.URL.Path == metadataProjectIDPath:
+		s.writeText(w, s.ProjectID)
+	case strings.HasPrefix(r.URL.Path, metadataServiceAccountsPath):
+		s.serveServiceAccount(w, r, strings.TrimPrefix(r.URL.Path, metadataServiceAccountsPath))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *MetadataServer) serveServiceAccount(w http.ResponseWriter, r *http.Request, rest string) {
+	if rest == "" {
+		s.writeText(w, "default/\n"+s.ServiceAccountEmail+"/")
+		return
+	}
+
+	account, attr, _ := strings.Cut(rest, "/")
+	if account != "default" && account != s.ServiceAccountEmail {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch attr {
+	case "":
+		if r.URL.Query().Get("recursive") != "true" {
+			s.writeText(w, "aliases\nemail\nscopes\ntoken")
+			return
+		}
+		s.writeJSON(w, metadataServiceAccountResponse{
+			Aliases: []string{"default"},
+			Email:   s.ServiceAccountEmail,
+			Scopes:  []string{CloudPlatformScope},
+		})
+	case "aliases":
+		s.writeText(w, "default")
+	case "email":
+		s.writeText(w, s.ServiceAccountEmail)
+	case "scopes":
+		s.writeText(w, CloudPlatformScope)
+	case "token":
+		token, err := s.TokenSource.Token(r.Context())
+		if err != nil {
+			s.Logger.Error(err, "Failed to acquire access token")
+			http.Error(w, "failed to acquire access token", http.StatusInternalServerError)
+			return
+		}
+		s.writeJSON(w, metadataTokenResponse{
+			AccessToken: token.Token,
+			ExpiresIn:   int64(math.Max(0, time.Until(token.Expiry).Seconds())),
+			TokenType:   "Bearer",
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *MetadataServer) writeText(w http.ResponseWriter, v string) {
+	w.Header().Set("Content-Type", "application/text")
+	_, _ = fmt.Fprint(w, v)
+}
+
+func (s *MetadataServer) writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		s.Logger.Error(err, "Failed to write response")
+	}
+}
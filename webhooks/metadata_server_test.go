@@ -0,0 +1,103 @@
+package webhooks
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-logr/logr"
+)
+
+func TestMetadataServer(t *testing.T) {
+	const saEmail = "sa@project.iam.gserviceaccount.com"
+	sts := newFakeSTS(t, "k8s-token")
+	server := httptest.NewServer(&MetadataServer{
+		TokenSource:         &CachingTokenSource{Source: &ExternalAccountTokenSource{Credentials: sts.credentials(t, saEmail)}},
+		ServiceAccountEmail: saEmail,
+		ProjectID:           "project",
+		Logger:              logr.Discard(),
+	})
+	t.Cleanup(server.Close)
+
+	get := func(t *testing.T, path string, flavor bool) (int, string) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if flavor {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer func() { _ = resp.Body.Close() }()
+		if resp.Header.Get("Metadata-Flavor") != "Google" {
+			t.Errorf("GET %s: Metadata-Flavor response header is missing", path)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+
+	t.Run("rejects requests without Metadata-Flavor header", func(t *testing.T) {
+		if code, _ := get(t, "/computeMetadata/v1/instance/service-accounts/default/token", false); code != http.StatusForbidden {
+			t.Errorf("status = %d, want %d", code, http.StatusForbidden)
+		}
+	})
+
+	t.Run("serves the root for detection", func(t *testing.T) {
+		if code, _ := get(t, "/", false); code != http.StatusOK {
+			t.Errorf("status = %d, want %d", code, http.StatusOK)
+		}
+	})
+
+	t.Run("serves email and project id", func(t *testing.T) {
+		for path, want := range map[string]string{
+			"/computeMetadata/v1/instance/service-accounts/default/email":         saEmail,
+			"/computeMetadata/v1/instance/service-accounts/" + saEmail + "/email": saEmail,
+			"/computeMetadata/v1/project/project-id":                              "project",
+		} {
+			code, body := get(t, path, true)
+			if code != http.StatusOK || body != want {
+				t.Errorf("GET %s = (%d, %q), want (200, %q)", path, code, body, want)
+			}
+		}
+	})
+
+	t.Run("serves the access token via STS exchange", func(t *testing.T) {
+		code, body := get(t, "/computeMetadata/v1/instance/service-accounts/default/token", true)
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", code, body)
+		}
+		resp := metadataTokenResponse{}
+		if err := json.Unmarshal([]byte(body), &resp); err != nil {
+			t.Fatalf("invalid json: %v", err)
+		}
+		if resp.AccessToken != "gsa-token" || resp.TokenType != "Bearer" || resp.ExpiresIn <= 0 {
+			t.Errorf("token response = %+v", resp)
+		}
+	})
+
+	t.Run("serves every attribute in the listing", func(t *testing.T) {
+		const account = "/computeMetadata/v1/instance/service-accounts/default/"
+		code, listing := get(t, account, true)
+		if code != http.StatusOK {
+			t.Fatalf("status = %d, body = %s", code, listing)
+		}
+		for _, attr := range strings.Split(listing, "\n") {
+			if code, body := get(t, account+attr, true); code != http.StatusOK {
+				t.Errorf("GET %s = (%d, %q), want 200", account+attr, code, body)
+			}
+		}
+	})
+
+	t.Run("returns 404 for other service accounts", func(t *testing.T) {
+		if code, _ := get(t, "/computeMetadata/v1/instance/service-accounts/other@project.iam.gserviceaccount.com/token", true); code != http.StatusNotFound {
+			t.Errorf("status = %d, want %d", code, http.StatusNotFound)
+		}
+	})
+}
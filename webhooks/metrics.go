@@ -0,0 +1,30 @@
+package webhooks
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const metricsNamespace = "gcp_workload_identity_federation_webhook"
+
+var (
+	injectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "injections_total",
+		Help:      "Number of Pods mutated by injection mode. implicit_default is true when the ServiceAccount relies on the default injection mode.",
+	}, []string{"mode", "implicit_default"})
+	serviceAccountCacheMissesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "serviceaccount_cache_misses_total",
+		Help:      "Number of ServiceAccounts not found in the cache and looked up from the API server, by the result (found, not_found or error).",
+	}, []string{"result"})
+	servingCertificateExpirationTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "serving_certificate_expiration_timestamp_seconds",
+		Help:      "Expiration time of the currently served certificate of the webhook in seconds since the Unix epoch.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(injectionsTotal, serviceAccountCacheMissesTotal, servingCertificateExpirationTimestamp)
+}
@@ -0,0 +1,65 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestInjectionsTotal(t *testing.T) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "app",
+		Annotations: map[string]string{
+			AnnotationDomainDefault + "/" + WorkloadIdentityProviderAnnotation: "projects/123/locations/global/workloadIdentityPools/pool/providers/provider",
+			AnnotationDomainDefault + "/" + ServiceAccountEmailAnnotation:      "app@project.iam.gserviceaccount.com",
+			AnnotationDomainDefault + "/" + InjectionModeAnnotation:            string(DirectMode),
+		},
+	}}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "app"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "app", Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newPatchTestMutator()
+	m.Client = fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sa).Build()
+	m.decoder = admission.NewDecoder(scheme.Scheme)
+	counter := injectionsTotal.WithLabelValues(string(DirectMode), "false")
+	before := testutil.ToFloat64(counter)
+
+	idConfig, err := NewGCPWorkloadIdentityConfig(m.AnnotationDomain, *sa)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := m.mutatePod(pod.DeepCopy(), *idConfig, podSecurity{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := testutil.ToFloat64(counter); v != before {
+		t.Errorf("mutatePod() incremented injections_total to %v from %v, want only admitted Pods counted", v, before)
+	}
+
+	resp := m.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:       "uid",
+		Namespace: "default",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if !resp.Allowed || len(resp.Patches) == 0 {
+		t.Fatalf("Handle() = %+v, want the patched response", resp.Result)
+	}
+	if v := testutil.ToFloat64(counter); v != before+1 {
+		t.Errorf("injections_total = %v after Handle(), want %v", v, before+1)
+	}
+}
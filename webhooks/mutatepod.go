@@ -4,10 +4,14 @@ import (
 	"fmt"
 	"path/filepath"
 	"regexp"
-	"strconv"
+	"slices"
 	"strings"
 
+	"gomodules.xyz/jsonpatch/v2"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/pod-security-admission/api"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 )
 
 var projectRegex *regexp.Regexp
@@ -16,42 +20,44 @@ func init() {
 	projectRegex = regexp.MustCompile(`@(.*).iam.gserviceaccount.com`)
 }
 
-func (m *GCPWorkloadIdentityMutator) mutatePod(pod *corev1.Pod, idConfig GCPWorkloadIdentityConfig) error {
-	audience := m.DefaultAudience
-	if idConfig.Audience != nil {
-		audience = *idConfig.Audience
-	}
-
-	expirationSeconds := int64(m.DefaultTokenExpiration.Seconds())
-	if idConfig.TokenExpirationSeconds != nil {
-		expirationSeconds = *idConfig.TokenExpirationSeconds
-	}
-	if expRaw, ok := pod.Annotations[filepath.Join(m.AnnotationDomain, TokenExpirationAnnotation)]; ok {
-		seconds, err := strconv.ParseInt(expRaw, 10, 64)
-		if err != nil {
-			return fmt.Errorf("%s must be positive integer string: %w", filepath.Join(m.AnnotationDomain, TokenExpirationAnnotation), err)
-		}
-		expirationSeconds = seconds
-	}
-	if expirationSeconds < int64(m.MinTokenExpration.Seconds()) {
-		expirationSeconds = int64(m.MinTokenExpration.Seconds())
+// mutatePod mutates the pod in place and returns the JSON patch operations of the mutation.
+// The injected container is shaped for podSecurity of the namespace of the pod.
+// It records the resolved identity and the skipped containers to record unless it is nil
+func (m *GCPWorkloadIdentityMutator) mutatePod(pod *corev1.Pod, idConfig GCPWorkloadIdentityConfig, podSecurity podSecurity, record *AuditRecord) ([]jsonpatch.JsonPatchOperation, admission.Warnings, error) {
+	resolved, warnings, err := idConfig.Resolve(m.AnnotationDomain, pod, m.podOverridableAnnotations(), m.resolveDefaults())
+	if err != nil {
+		return nil, nil, err
 	}
+	patch := &podPatch{}
+	idConfig = *resolved
+	record.auditResolved(idConfig)
+	audience := *idConfig.Audience
+	expirationSeconds := *idConfig.TokenExpirationSeconds
 
 	// mutate annotations
-	if pod.Annotations == nil {
+	if len(pod.Annotations) == 0 {
 		pod.Annotations = map[string]string{}
+		patch.add("/metadata/annotations", map[string]string{})
 	}
-	pod.Annotations[filepath.Join(m.AnnotationDomain, WorkloadIdentityProviderAnnotation)] = *idConfig.WorkloadIdentityProvider
-	pod.Annotations[filepath.Join(m.AnnotationDomain, ServiceAccountEmailAnnotation)] = *idConfig.ServiceAccountEmail
-	pod.Annotations[filepath.Join(m.AnnotationDomain, AudienceAnnotation)] = audience
-	pod.Annotations[filepath.Join(m.AnnotationDomain, TokenExpirationAnnotation)] = fmt.Sprint(expirationSeconds)
+	patch.setAnnotation(pod.Annotations, filepath.Join(m.AnnotationDomain, WorkloadIdentityProviderAnnotation), *idConfig.WorkloadIdentityProvider)
+	patch.setAnnotation(pod.Annotations, filepath.Join(m.AnnotationDomain, ServiceAccountEmailAnnotation), *idConfig.ServiceAccountEmail)
+	patch.setAnnotation(pod.Annotations, filepath.Join(m.AnnotationDomain, AudienceAnnotation), audience)
+	patch.setAnnotation(pod.Annotations, filepath.Join(m.AnnotationDomain, TokenExpirationAnnotation), fmt.Sprint(expirationSeconds))
 	if idConfig.InjectionMode == DirectMode {
 		// Add annotation
 		credBody, err := buildExternalCredentialsJson(*idConfig.WorkloadIdentityProvider, *idConfig.ServiceAccountEmail)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		pod.Annotations[filepath.Join(m.AnnotationDomain, ExternalCredentialsJsonAnnotation)] = credBody
+		patch.setAnnotation(pod.Annotations, filepath.Join(m.AnnotationDomain, ExternalCredentialsJsonAnnotation), credBody)
+	}
+	tokenFiles := identityTokenFiles(audience, idConfig.AdditionalIdentities)
+	for _, id := range idConfig.AdditionalIdentities {
+		credBody, err := buildExternalCredentialsJsonWithTokenFile(id.WorkloadIdentityProvider, id.ServiceAccountEmail, tokenFiles[id.Name])
+		if err != nil {
+			return nil, nil, err
+		}
+		patch.setAnnotation(pod.Annotations, filepath.Join(m.AnnotationDomain, ExternalCredentialsJsonAnnotation)+"."+id.Name, credBody)
 	}
 
 	//
@@ -62,55 +68,170 @@ func (m *GCPWorkloadIdentityMutator) mutatePod(pod *corev1.Pod, idConfig GCPWork
 	if len(matches) >= 2 {
 		project = matches[1] // the group 0 is thw whole match
 	}
+	if project == "" {
+		warnings = append(warnings, fmt.Sprintf("could not derive the GCP project from %q, CLOUDSDK_CORE_PROJECT is set to empty", *idConfig.ServiceAccountEmail))
+	}
 
 	//
 	// mutate volumes(k8s sa token volume, gcloud config volume)
 	//
-	for _, v := range m.volumesToAddOrReplace(audience, expirationSeconds, int32(m.DefaultMode), idConfig.InjectionMode) {
-		pod.Spec.Volumes = addOrReplaceVolume(pod.Spec.Volumes, v)
+	volumes := m.volumesToAddOrReplace(audience, expirationSeconds, int32(m.DefaultMode), idConfig.InjectionMode)
+	volumeMounts := volumeMountsToAddOrReplace(idConfig.InjectionMode)
+	if len(idConfig.AdditionalIdentities) > 0 {
+		// volumes[0] is the k8s sa token volume
+		volumes[0].Projected.Sources = append(volumes[0].Projected.Sources, identityTokenProjections(audience, idConfig.AdditionalIdentities, expirationSeconds)...)
+		volumes = append(volumes, m.identityCredentialsVolume(idConfig.AdditionalIdentities, int32(m.DefaultMode)))
+		if !slices.Contains(volumeMounts, k8sSATokenVolumeMount) {
+			volumeMounts = append(volumeMounts, k8sSATokenVolumeMount)
+		}
+		volumeMounts = append(volumeMounts, identityCredentialsVolumeMount)
+	}
+	for _, v := range volumes {
+		if conflict := volumeConflict(pod.Spec.Volumes, v); conflict != "" {
+			if m.conflictPolicy() != ConflictPolicyReplace {
+				return nil, nil, conflictError(m.conflictPolicy(), conflict)
+			}
+			warnings = append(warnings, conflict+"; replaced by the webhook")
+		}
+		pod.Spec.Volumes = addOrReplaceVolume(patch, "/spec/volumes", pod.Spec.Volumes, v)
 	}
 
 	//
-	// inject gcloud setup initContainer
+	// inject gcloud setup initContainer or sidecars
 	//
-	if idConfig.InjectionMode == GCloudMode || idConfig.InjectionMode == UndefinedMode {
-		pod.Spec.InitContainers = prependOrReplaceContainer(pod.Spec.InitContainers, gcloudSetupContainer(
+	var injectedContainer *corev1.Container
+	switch idConfig.InjectionMode {
+	case GCloudMode, UndefinedMode:
+		setupContainer := gcloudSetupContainer(
 			*idConfig.WorkloadIdentityProvider, *idConfig.ServiceAccountEmail, project, m.GcloudImage, idConfig.RunAsUser, m.SetupContainerResources,
-		))
+		)
+		if m.BootstrapImage != "" {
+			setupContainer = bootstrapSetupContainer(
+				*idConfig.WorkloadIdentityProvider, *idConfig.ServiceAccountEmail, project, m.DefaultGCloudRegion, m.BootstrapImage, idConfig.RunAsUser, m.SetupContainerResources,
+			)
+		}
+		injectedContainer = &setupContainer
+		if m.BootstrapImage == "" {
+			// the secrets are for pulling the gcloud image
+			for _, s := range m.GcloudImagePullSecrets {
+				pod.Spec.ImagePullSecrets = addIfNotPresentImagePullSecret(patch, "/spec/imagePullSecrets", pod.Spec.ImagePullSecrets, s)
+			}
+		}
+	case MetadataMode:
+		if m.SidecarImage == "" {
+			return nil, nil, fmt.Errorf("%s mode '%s' is not enabled in this webhook", filepath.Join(m.AnnotationDomain, InjectionModeAnnotation), MetadataMode)
+		}
+		sidecar := metadataServerContainer(
+			*idConfig.WorkloadIdentityProvider, *idConfig.ServiceAccountEmail, project, m.SidecarImage, idConfig.RunAsUser, m.SetupContainerResources,
+		)
+		injectedContainer = &sidecar
+	case AccessTokenMode:
+		if m.SidecarImage == "" {
+			return nil, nil, fmt.Errorf("%s mode '%s' is not enabled in this webhook", filepath.Join(m.AnnotationDomain, InjectionModeAnnotation), AccessTokenMode)
+		}
+		sidecar := accessTokenRefresherContainer(
+			*idConfig.WorkloadIdentityProvider, *idConfig.ServiceAccountEmail, m.SidecarImage, m.AccessTokenRefresher, idConfig.RunAsUser, m.SetupContainerResources,
+		)
+		injectedContainer = &sidecar
+	}
+	if injectedContainer != nil {
+		podSecurity.shapeInjectedContainer(pod.Spec.SecurityContext, injectedContainer)
+		if violations := podSecurityViolations(podSecurity.Enforce, pod, *injectedContainer); len(violations) > 0 {
+			return nil, nil, fmt.Errorf("the injected container violates the %s Pod Security Standards enforced in the namespace: %s", podSecurity.Enforce, strings.Join(violations, ", "))
+		}
+		if violations := podSecurityViolations(podSecurity.Warn, pod, *injectedContainer); len(violations) > 0 {
+			warnings = append(warnings, fmt.Sprintf("the injected container would violate the %s Pod Security Standards: %s", podSecurity.Warn, strings.Join(violations, ", ")))
+		}
+		if podSecurity.Enforce.Level == api.LevelRestricted && injectedContainer.Image == m.GcloudImage && m.BootstrapImage == "" &&
+			injectedContainer.SecurityContext.RunAsUser == nil && (pod.Spec.SecurityContext == nil || pod.Spec.SecurityContext.RunAsUser == nil) {
+			// the gcloud image runs as root, so the kubelet refuses to start it with runAsNonRoot
+			return nil, nil, fmt.Errorf(
+				"container %q would run as root with the image %s, which the kubelet refuses in the namespace enforcing the restricted Pod Security Standards; set the %s annotation of the ServiceAccount",
+				injectedContainer.Name, m.GcloudImage, filepath.Join(m.AnnotationDomain, RunAsUserAnnotation),
+			)
+		}
+		if slices.ContainsFunc(pod.Spec.Containers, func(c corev1.Container) bool { return c.Name == injectedContainer.Name }) {
+			// an init container can't replace it in any policy
+			return nil, nil, conflictError(m.conflictPolicy(), fmt.Sprintf("container %q collides with the injected init container", injectedContainer.Name))
+		}
+		if conflict := containerConflict(pod.Spec.InitContainers, *injectedContainer); conflict != "" {
+			if m.conflictPolicy() != ConflictPolicyReplace {
+				return nil, nil, conflictError(m.conflictPolicy(), conflict)
+			}
+			warnings = append(warnings, conflict+"; replaced by the webhook")
+		}
+		pod.Spec.InitContainers = prependOrReplaceContainer(patch, "/spec/initContainers", pod.Spec.InitContainers, *injectedContainer)
 	}
 
 	//
 	// mutate InitContainers/Containers
 	//
-	skipContainerNames := map[string]struct{}{
-		GCloudSetupInitContainerName: {},
+	skipContainerNames := map[string]struct{}{}
+	for _, name := range injectedContainerNames {
+		skipContainerNames[name] = struct{}{}
 	}
 	for _, name := range strings.Split(pod.Annotations[filepath.Join(m.AnnotationDomain, SkipContainersAnnotation)], ",") {
-		skipContainerNames[strings.TrimSpace(name)] = struct{}{}
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !slices.ContainsFunc(pod.Spec.InitContainers, func(c corev1.Container) bool { return c.Name == name }) &&
+			!slices.ContainsFunc(pod.Spec.Containers, func(c corev1.Container) bool { return c.Name == name }) {
+			warnings = append(warnings, fmt.Sprintf("%s has container %q which does not exist", filepath.Join(m.AnnotationDomain, SkipContainersAnnotation), name))
+		}
+		skipContainerNames[name] = struct{}{}
 	}
 	for i := range pod.Spec.InitContainers {
 		ctr := pod.Spec.InitContainers[i]
 		if _, ok := skipContainerNames[ctr.Name]; ok {
+			if !slices.Contains(injectedContainerNames, ctr.Name) {
+				record.auditSkippedContainer(ctr.Name)
+			}
 			continue
 		}
-		m.mutateContainer(&ctr, volumeMountsToAddOrReplace(idConfig.InjectionMode), envVarsToAddOrReplace(idConfig.InjectionMode), envVarsToAddIfNotPresent(m.DefaultGCloudRegion, project))
+		ws, mutated, err := m.mutateContainer(patch, indexOf("/spec/initContainers", i), &ctr, volumeMounts, envVarsToAddOrReplace(idConfig.InjectionMode), envVarsToAddIfNotPresent(m.DefaultGCloudRegion, project))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !mutated {
+			record.auditSkippedContainer(ctr.Name)
+		}
+		warnings = append(warnings, ws...)
 		pod.Spec.InitContainers[i] = ctr
 	}
 	for i := range pod.Spec.Containers {
 		ctr := pod.Spec.Containers[i]
 		if _, ok := skipContainerNames[ctr.Name]; ok {
+			if !slices.Contains(injectedContainerNames, ctr.Name) {
+				record.auditSkippedContainer(ctr.Name)
+			}
 			continue
 		}
-		m.mutateContainer(&ctr, volumeMountsToAddOrReplace(idConfig.InjectionMode), envVarsToAddOrReplace(idConfig.InjectionMode), envVarsToAddIfNotPresent(m.DefaultGCloudRegion, project))
+		ws, mutated, err := m.mutateContainer(patch, indexOf("/spec/containers", i), &ctr, volumeMounts, envVarsToAddOrReplace(idConfig.InjectionMode), envVarsToAddIfNotPresent(m.DefaultGCloudRegion, project))
+		if err != nil {
+			return nil, nil, err
+		}
+		if !mutated {
+			record.auditSkippedContainer(ctr.Name)
+		}
+		warnings = append(warnings, ws...)
 		pod.Spec.Containers[i] = ctr
 	}
 
-	return nil
+	return patch.ops, warnings, nil
 }
 
+// injectedContainerNames are the names of the containers injected by the webhook, which are never mutated
+var injectedContainerNames = []string{GCloudSetupInitContainerName, MetadataServerContainerName, AccessTokenRefresherName}
+
 func buildExternalCredentialsJson(wiProvider, gsaEmail string) (string, error) {
+	return buildExternalCredentialsJsonWithTokenFile(wiProvider, gsaEmail, K8sSATokenName)
+}
+
+func buildExternalCredentialsJsonWithTokenFile(wiProvider, gsaEmail, tokenFile string) (string, error) {
 	aud := fmt.Sprintf("//iam.googleapis.com/%s", wiProvider)
 	creds := NewExternalAccountCredentials(aud, gsaEmail)
+	creds.CredentialSource.File = filepath.Join(K8sSATokenMountPath, tokenFile)
 	credJson, err := creds.Render(false)
 	if err != nil {
 		return "", err
@@ -118,93 +239,150 @@ func buildExternalCredentialsJson(wiProvider, gsaEmail string) (string, error) {
 	return credJson, nil
 }
 
+// mutateContainer adds the patch operations of the container at path to patch
 func (m *GCPWorkloadIdentityMutator) mutateContainer(
+	patch *podPatch,
+	path string,
 	ctr *corev1.Container,
 	volumeMountsToAdd []corev1.VolumeMount,
 	envVarsToAddOrReplace []corev1.EnvVar,
 	envVarsToAddIfNotPresent []corev1.EnvVar,
-) {
+) (admission.Warnings, bool, error) {
+	var warnings admission.Warnings
+	if conflicts := volumeMountConflicts(*ctr, volumeMountsToAdd); len(conflicts) > 0 {
+		switch m.conflictPolicy() {
+		case ConflictPolicyReject:
+			return nil, false, conflictError(ConflictPolicyReject, conflicts...)
+		case ConflictPolicySkipContainer:
+			return admission.Warnings{fmt.Sprintf("container %q is not mutated: %s", ctr.Name, strings.Join(conflicts, "; "))}, false, nil
+		default:
+			for _, c := range conflicts {
+				warnings = append(warnings, c+"; replaced by the webhook")
+			}
+		}
+	}
 	for i := range volumeMountsToAdd {
-		ctr.VolumeMounts = addOrReplaceVolumeMount(ctr.VolumeMounts, volumeMountsToAdd[i])
+		ctr.VolumeMounts = removeVolumeMountsAt(patch, path+"/volumeMounts", ctr.VolumeMounts, volumeMountsToAdd[i].Name, volumeMountsToAdd[i].MountPath)
+		ctr.VolumeMounts = addOrReplaceVolumeMount(patch, path+"/volumeMounts", ctr.VolumeMounts, volumeMountsToAdd[i])
 	}
+	var replaced bool
 	for i := range envVarsToAddOrReplace {
-		ctr.Env = addOrReplaceEnvVar(ctr.Env, envVarsToAddOrReplace[i])
+		if ctr.Env, replaced = addOrReplaceEnvVar(patch, path+"/env", ctr.Env, envVarsToAddOrReplace[i]); replaced {
+			warnings = append(warnings, fmt.Sprintf("env %s of container %q is overridden by the webhook", envVarsToAddOrReplace[i].Name, ctr.Name))
+		}
 	}
 	for i := range envVarsToAddIfNotPresent {
-		ctr.Env = addIfNotPresentEnvVar(ctr.Env, envVarsToAddIfNotPresent[i])
+		ctr.Env = addIfNotPresentEnvVar(patch, path+"/env", ctr.Env, envVarsToAddIfNotPresent[i])
+	}
+	return warnings, true, nil
+}
+
+func (m *GCPWorkloadIdentityMutator) resolveDefaults() ResolveDefaults {
+	return ResolveDefaults{
+		Audience:                 m.DefaultAudience,
+		TokenExpiration:          m.DefaultTokenExpiration,
+		MinTokenExpiration:       m.MinTokenExpration,
+		MaxTokenExpiration:       m.MaxTokenExpiration,
+		InjectionMode:            m.DefaultInjectionMode,
+		DeprecatedInjectionModes: m.DeprecatedInjectionModes,
+	}
+}
+
+func (m *GCPWorkloadIdentityMutator) podOverridableAnnotations() []string {
+	if m.PodOverridableAnnotations == nil {
+		return []string{TokenExpirationAnnotation}
 	}
+	return m.PodOverridableAnnotations
 }
 
-func prependOrReplaceContainer(ctrs []corev1.Container, ctr corev1.Container) []corev1.Container {
-	replaced := false
+func (m *GCPWorkloadIdentityMutator) conflictPolicy() ConflictPolicy {
+	if m.ConflictPolicy == "" {
+		return ConflictPolicyReplace
+	}
+	return m.ConflictPolicy
+}
+
+// The helpers below add the patch operations to patch, the path of which is the JSON pointer of the list.
+// They leave the elements semantically equal to the given ones as they are.
+
+func prependOrReplaceContainer(patch *podPatch, path string, ctrs []corev1.Container, ctr corev1.Container) []corev1.Container {
 	for i, c := range ctrs {
 		if c.Name == ctr.Name {
-			ctrs[i] = ctr
-			replaced = true
-			break
+			if !equality.Semantic.DeepEqual(c, ctr) {
+				ctrs[i] = ctr
+				patch.replace(indexOf(path, i), ctr)
+			}
+			return ctrs
 		}
 	}
-	if !replaced {
-		ctrs = append([]corev1.Container{ctr}, ctrs...)
+	if len(ctrs) == 0 {
+		patch.add(path, []corev1.Container{ctr})
+	} else {
+		patch.add(indexOf(path, 0), ctr)
 	}
-
-	return ctrs
+	return append([]corev1.Container{ctr}, ctrs...)
 }
 
-func addOrReplaceVolume(volumes []corev1.Volume, volume corev1.Volume) []corev1.Volume {
-	replaced := false
+func addOrReplaceVolume(patch *podPatch, path string, volumes []corev1.Volume, volume corev1.Volume) []corev1.Volume {
 	for i, v := range volumes {
 		if v.Name == volume.Name {
-			volumes[i] = volume
-			replaced = true
-			break
+			if !equality.Semantic.DeepEqual(v, volume) {
+				volumes[i] = volume
+				patch.replace(indexOf(path, i), volume)
+			}
+			return volumes
 		}
 	}
-	if !replaced {
-		volumes = append(volumes, volume)
-	}
-	return volumes
+	patch.append(path, len(volumes), volume)
+	return append(volumes, volume)
 }
 
-func addOrReplaceVolumeMount(volumeMounts []corev1.VolumeMount, volumeMount corev1.VolumeMount) []corev1.VolumeMount {
-	replaced := false
+func addOrReplaceVolumeMount(patch *podPatch, path string, volumeMounts []corev1.VolumeMount, volumeMount corev1.VolumeMount) []corev1.VolumeMount {
 	for i, v := range volumeMounts {
 		if v.Name == volumeMount.Name {
-			volumeMounts[i] = volumeMount
-			replaced = true
-			break
+			if !equality.Semantic.DeepEqual(v, volumeMount) {
+				volumeMounts[i] = volumeMount
+				patch.replace(indexOf(path, i), volumeMount)
+			}
+			return volumeMounts
 		}
 	}
-	if !replaced {
-		volumeMounts = append(volumeMounts, volumeMount)
-	}
-	return volumeMounts
+	patch.append(path, len(volumeMounts), volumeMount)
+	return append(volumeMounts, volumeMount)
 }
-func addOrReplaceEnvVar(envVars []corev1.EnvVar, envVar corev1.EnvVar) []corev1.EnvVar {
-	replaced := false
+
+// addOrReplaceEnvVar returns true as well when it replaced a different env var with the same name
+func addOrReplaceEnvVar(patch *podPatch, path string, envVars []corev1.EnvVar, envVar corev1.EnvVar) ([]corev1.EnvVar, bool) {
 	for i, v := range envVars {
 		if v.Name == envVar.Name {
+			if equality.Semantic.DeepEqual(v, envVar) {
+				return envVars, false
+			}
 			envVars[i] = envVar
-			replaced = true
-			break
+			patch.replace(indexOf(path, i), envVar)
+			return envVars, true
 		}
 	}
-	if !replaced {
-		envVars = append(envVars, envVar)
+	patch.append(path, len(envVars), envVar)
+	return append(envVars, envVar), false
+}
+
+func addIfNotPresentImagePullSecret(patch *podPatch, path string, secrets []corev1.LocalObjectReference, secret corev1.LocalObjectReference) []corev1.LocalObjectReference {
+	for _, s := range secrets {
+		if s.Name == secret.Name {
+			return secrets
+		}
 	}
-	return envVars
+	patch.append(path, len(secrets), secret)
+	return append(secrets, secret)
 }
 
-func addIfNotPresentEnvVar(envVars []corev1.EnvVar, envVar corev1.EnvVar) []corev1.EnvVar {
-	exists := false
+func addIfNotPresentEnvVar(patch *podPatch, path string, envVars []corev1.EnvVar, envVar corev1.EnvVar) []corev1.EnvVar {
 	for _, v := range envVars {
 		if v.Name == envVar.Name {
-			exists = true
-			break
+			return envVars
 		}
 	}
-	if !exists {
-		envVars = append(envVars, envVar)
-	}
-	return envVars
+	patch.append(path, len(envVars), envVar)
+	return append(envVars, envVar)
 }
@@ -19,6 +19,14 @@ var (
 			EmptyDir: &corev1.EmptyDirVolumeSource{},
 		},
 	}
+	accessTokenVolume = corev1.Volume{
+		Name: AccessTokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{
+				Medium: corev1.StorageMediumMemory,
+			},
+		},
+	}
 )
 
 func (m *GCPWorkloadIdentityMutator) volumesToAddOrReplace(
@@ -29,9 +37,14 @@ func (m *GCPWorkloadIdentityMutator) volumesToAddOrReplace(
 ) []corev1.Volume {
 	vols := []corev1.Volume{k8sSATokenVolume(audience, expirationSeconds, defaultMode)}
 
-	if mode == DirectMode {
+	switch mode {
+	case DirectMode:
 		vols = append(vols, m.externalCredConfigVolume(defaultMode))
-	} else {
+	case MetadataMode:
+		// the token is read only by the metadata server sidecar
+	case AccessTokenMode:
+		vols = append(vols, accessTokenVolume)
+	default:
 		vols = append(vols, gcloudConfigVolume)
 	}
 
@@ -87,20 +100,6 @@ func gcloudSetupContainer(
 	runAsUser *int64,
 	resources *corev1.ResourceRequirements,
 ) corev1.Container {
-	// for Restricted Profile in Pod Security Standards
-	securityContext := &corev1.SecurityContext{
-		AllowPrivilegeEscalation: ptr.To(false),
-		Capabilities: &corev1.Capabilities{
-			Drop: []corev1.Capability{
-				"ALL",
-			},
-		},
-	}
-
-	if runAsUser != nil {
-		securityContext.RunAsUser = runAsUser
-	}
-
 	c := corev1.Container{
 		Name:  GCloudSetupInitContainerName,
 		Image: gcloudImage,
@@ -129,7 +128,146 @@ func gcloudSetupContainer(
 			Name:  "CLOUDSDK_CONFIG",
 			Value: GCloudConfigMountPath,
 		}, projectEnvVar(project)},
-		SecurityContext: securityContext,
+		SecurityContext: setupContainerSecurityContext(runAsUser),
+	}
+	if resources != nil {
+		c.Resources = *resources
+	}
+	return c
+}
+
+// bootstrapSetupContainer is the drop-in replacement of gcloudSetupContainer which runs the built-in
+// bootstrap subcommand of this webhook's image instead of the google-cloud-cli image.
+func bootstrapSetupContainer(
+	workloadIdProvider, saEmail, project, region, bootstrapImage string,
+	runAsUser *int64,
+	resources *corev1.ResourceRequirements,
+) corev1.Container {
+	args := []string{
+		"bootstrap",
+		"--workload-identity-provider=$(GCP_WORKLOAD_IDENTITY_PROVIDER)",
+		"--service-account=$(GCP_SERVICE_ACCOUNT)",
+		"--config-dir=$(CLOUDSDK_CONFIG)",
+		"--credential-source-file=" + filepath.Join(K8sSATokenMountPath, K8sSATokenName),
+		"--project=$(CLOUDSDK_CORE_PROJECT)",
+	}
+	if region != "" {
+		args = append(args, "--region="+region)
+	}
+
+	c := corev1.Container{
+		Name:         GCloudSetupInitContainerName,
+		Image:        bootstrapImage,
+		Command:      []string{BootstrapCommand},
+		Args:         args,
+		VolumeMounts: volumeMountsToAddOrReplace(GCloudMode),
+		Env: []corev1.EnvVar{{
+			Name:  "GCP_WORKLOAD_IDENTITY_PROVIDER",
+			Value: workloadIdProvider,
+		}, {
+			Name:  "GCP_SERVICE_ACCOUNT",
+			Value: saEmail,
+		}, {
+			Name:  "CLOUDSDK_CONFIG",
+			Value: GCloudConfigMountPath,
+		}, projectEnvVar(project)},
+		SecurityContext: setupContainerSecurityContext(runAsUser),
+	}
+	if resources != nil {
+		c.Resources = *resources
+	}
+	return c
+}
+
+// metadataServerContainer is a native sidecar (an init container with restartPolicy: Always) which runs
+// the built-in metadata-server subcommand, so that it starts before and keeps running alongside the containers.
+// Its startupProbe holds the containers until the server listens.
+func metadataServerContainer(
+	workloadIdProvider, saEmail, project, image string,
+	runAsUser *int64,
+	resources *corev1.ResourceRequirements,
+) corev1.Container {
+	c := corev1.Container{
+		Name:    MetadataServerContainerName,
+		Image:   image,
+		Command: []string{BootstrapCommand},
+		Args: []string{
+			"metadata-server",
+			"--workload-identity-provider=$(GCP_WORKLOAD_IDENTITY_PROVIDER)",
+			"--service-account=$(GCP_SERVICE_ACCOUNT)",
+			"--credential-source-file=" + filepath.Join(K8sSATokenMountPath, K8sSATokenName),
+			"--project=$(CLOUDSDK_CORE_PROJECT)",
+			"--listen-address=" + MetadataServerAddress,
+		},
+		RestartPolicy: ptr.To(corev1.ContainerRestartPolicyAlways),
+		// the server listens only on the loopback address, which httpGet and tcpSocket probes can't reach
+		StartupProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				Exec: &corev1.ExecAction{
+					Command: []string{BootstrapCommand, "metadata-server", "--check", "--listen-address=" + MetadataServerAddress},
+				},
+			},
+			PeriodSeconds:    1,
+			FailureThreshold: 300,
+		},
+		VolumeMounts: []corev1.VolumeMount{k8sSATokenVolumeMount},
+		Env: []corev1.EnvVar{{
+			Name:  "GCP_WORKLOAD_IDENTITY_PROVIDER",
+			Value: workloadIdProvider,
+		}, {
+			Name:  "GCP_SERVICE_ACCOUNT",
+			Value: saEmail,
+		}, projectEnvVar(project)},
+		SecurityContext: setupContainerSecurityContext(runAsUser),
+	}
+	if resources != nil {
+		c.Resources = *resources
+	}
+	return c
+}
+
+// accessTokenRefresherContainer is a native sidecar which runs the built-in access-token-refresher subcommand.
+// Its startupProbe holds the containers until the first access token is written.
+func accessTokenRefresherContainer(
+	workloadIdProvider, saEmail, image string,
+	opts AccessTokenRefresherOptions,
+	runAsUser *int64,
+	resources *corev1.ResourceRequirements,
+) corev1.Container {
+	tokenFile := filepath.Join(AccessTokenMountPath, AccessTokenFilename)
+	c := corev1.Container{
+		Name:    AccessTokenRefresherName,
+		Image:   image,
+		Command: []string{BootstrapCommand},
+		Args: append([]string{
+			"access-token-refresher",
+			"--workload-identity-provider=$(GCP_WORKLOAD_IDENTITY_PROVIDER)",
+			"--service-account=$(GCP_SERVICE_ACCOUNT)",
+			"--credential-source-file=" + filepath.Join(K8sSATokenMountPath, K8sSATokenName),
+			"--token-file=" + tokenFile,
+		}, opts.args()...),
+		RestartPolicy: ptr.To(corev1.ContainerRestartPolicyAlways),
+		StartupProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				Exec: &corev1.ExecAction{
+					Command: []string{BootstrapCommand, "access-token-refresher", "--check", "--token-file=" + tokenFile},
+				},
+			},
+			PeriodSeconds:    1,
+			FailureThreshold: 300,
+		},
+		VolumeMounts: []corev1.VolumeMount{k8sSATokenVolumeMount, {
+			Name:      AccessTokenVolumeName,
+			MountPath: AccessTokenMountPath,
+		}},
+		Env: []corev1.EnvVar{{
+			Name:  "GCP_WORKLOAD_IDENTITY_PROVIDER",
+			Value: workloadIdProvider,
+		}, {
+			Name:  "GCP_SERVICE_ACCOUNT",
+			Value: saEmail,
+		}},
+		SecurityContext: setupContainerSecurityContext(runAsUser),
 	}
 	if resources != nil {
 		c.Resources = *resources
@@ -137,6 +275,24 @@ func gcloudSetupContainer(
 	return c
 }
 
+func setupContainerSecurityContext(runAsUser *int64) *corev1.SecurityContext {
+	// for Restricted Profile in Pod Security Standards, which also requires runAsNonRoot and seccompProfile set by
+	// podSecurity.shapeInjectedContainer in the namespaces enforcing it because they may break the existing Pods
+	securityContext := &corev1.SecurityContext{
+		AllowPrivilegeEscalation: ptr.To(false),
+		Capabilities: &corev1.Capabilities{
+			Drop: []corev1.Capability{
+				"ALL",
+			},
+		},
+	}
+
+	if runAsUser != nil {
+		securityContext.RunAsUser = runAsUser
+	}
+	return securityContext
+}
+
 // VolumeMounts
 var (
 	externalCredConfigVolumeMount = corev1.VolumeMount{
@@ -153,9 +309,22 @@ var (
 		Name:      GCloudConfigVolumeName,
 		MountPath: GCloudConfigMountPath,
 	}
+	accessTokenVolumeMount = corev1.VolumeMount{
+		Name:      AccessTokenVolumeName,
+		MountPath: AccessTokenMountPath,
+		ReadOnly:  true,
+	}
 )
 
 func volumeMountsToAddOrReplace(mode InjectionMode) []corev1.VolumeMount {
+	switch mode {
+	case MetadataMode:
+		// containers talk to the metadata server sidecar instead of reading the token
+		return nil
+	case AccessTokenMode:
+		return []corev1.VolumeMount{accessTokenVolumeMount}
+	}
+
 	volMounts := []corev1.VolumeMount{k8sSATokenVolumeMount}
 
 	if mode == DirectMode {
@@ -176,6 +345,24 @@ func envVarsToAddOrReplace(mode InjectionMode) []corev1.EnvVar {
 				Value: filepath.Join(DirectInjectedExternalMountPath, ExternalCredConfigFilename),
 			},
 		}
+	} else if mode == AccessTokenMode {
+		return []corev1.EnvVar{
+			{
+				Name:  "CLOUDSDK_AUTH_ACCESS_TOKEN_FILE",
+				Value: filepath.Join(AccessTokenMountPath, AccessTokenFilename),
+			},
+		}
+	} else if mode == MetadataMode {
+		return []corev1.EnvVar{
+			{
+				Name:  "GCE_METADATA_HOST",
+				Value: MetadataServerAddress,
+			},
+			{
+				Name:  "GCE_METADATA_IP",
+				Value: MetadataServerAddress,
+			},
+		}
 	} else {
 		return []corev1.EnvVar{
 			{
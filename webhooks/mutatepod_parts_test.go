@@ -105,3 +105,38 @@ gcloud auth login --cred-file=$(CLOUDSDK_CONFIG)/federation.json
 		}
 	})
 }
+
+func TestBootstrapSetupContainer(t *testing.T) {
+	const (
+		workloadIdProvider = "projects/12345/locations/global/workloadIdentityPools/on-prem-kubernetes/providers/this-cluster"
+		saEmail            = "app-x@project.iam.googleapis.com"
+		project            = "project"
+		bootstrapImage     = "ghcr.io/pfnet-research/gcp-workload-identity-federation-webhook:latest"
+	)
+
+	t.Run("Without region", func(t *testing.T) {
+		actual := bootstrapSetupContainer(workloadIdProvider, saEmail, project, "", bootstrapImage, nil, nil)
+
+		expected := gcloudSetupContainer(workloadIdProvider, saEmail, project, bootstrapImage, nil, nil)
+		expected.Command = []string{"/gcp-workload-identity-federation-webhook"}
+		expected.Args = []string{
+			"bootstrap",
+			"--workload-identity-provider=$(GCP_WORKLOAD_IDENTITY_PROVIDER)",
+			"--service-account=$(GCP_SERVICE_ACCOUNT)",
+			"--config-dir=$(CLOUDSDK_CONFIG)",
+			"--credential-source-file=/var/run/secrets/sts.googleapis.com/serviceaccount/token",
+			"--project=$(CLOUDSDK_CORE_PROJECT)",
+		}
+
+		if diff := cmp.Diff(actual, expected); diff != "" {
+			t.Errorf("bootstrapSetupContainer() mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("With region", func(t *testing.T) {
+		actual := bootstrapSetupContainer(workloadIdProvider, saEmail, project, "asia-northeast1", bootstrapImage, nil, nil)
+		if last := actual.Args[len(actual.Args)-1]; last != "--region=asia-northeast1" {
+			t.Errorf("bootstrapSetupContainer() last arg = %q, want %q", last, "--region=asia-northeast1")
+		}
+	})
+}
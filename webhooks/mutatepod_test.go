@@ -3,6 +3,7 @@ package webhooks
 import (
 	"fmt"
 	"path/filepath"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -19,13 +20,14 @@ var _ = Describe("GCPWorkloadIdentityMutator.mutatePod", func() {
 	project := "demo"
 	BeforeEach(func() {
 		m = &GCPWorkloadIdentityMutator{
-			AnnotationDomain:       annotaitonDomain,
-			DefaultAudience:        AudienceDefault,
-			DefaultTokenExpiration: DefaultTokenExpirationDefault,
-			MinTokenExpration:      MinTokenExprationDefault,
-			DefaultGCloudRegion:    DefaultGCloudRegionDefault,
-			GcloudImage:            GcloudImageDefault,
-			DefaultMode:            defaultMode,
+			AnnotationDomain:          annotaitonDomain,
+			DefaultAudience:           AudienceDefault,
+			DefaultTokenExpiration:    DefaultTokenExpirationDefault,
+			MinTokenExpration:         MinTokenExprationDefault,
+			PodOverridableAnnotations: []string{TokenExpirationAnnotation},
+			DefaultGCloudRegion:       DefaultGCloudRegionDefault,
+			GcloudImage:               GcloudImageDefault,
+			DefaultMode:               defaultMode,
 			SetupContainerResources: &corev1.ResourceRequirements{
 				Requests: corev1.ResourceList{
 					corev1.ResourceCPU: resource.MustParse("100m"),
@@ -33,6 +35,34 @@ var _ = Describe("GCPWorkloadIdentityMutator.mutatePod", func() {
 			},
 		}
 	})
+	When("PodOverridableAnnotations is not set", func() {
+		idConfig := GCPWorkloadIdentityConfig{
+			WorkloadIdentityProvider: &workloadIdentityProviderFmt,
+			ServiceAccountEmail:      ptr.To(fmt.Sprintf("sa@%s.iam.gserviceaccount.com", project)),
+		}
+		pod := func() *corev1.Pod {
+			return &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{tokenExpirationAnnotation: "7200"},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "ctr", Image: "busybox"}}},
+			}
+		}
+		It("should allow Pods to override the token expiration by default", func() {
+			m.PodOverridableAnnotations = nil
+			p := pod()
+			_, _, err := m.mutatePod(p, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.ExpirationSeconds).To(Equal(ptr.To[int64](7200)))
+		})
+		It("should allow no overrides when it is empty", func() {
+			m.PodOverridableAnnotations = []string{}
+			p := pod()
+			_, _, err := m.mutatePod(p, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(p.Spec.Volumes[0].Projected.Sources[0].ServiceAccountToken.ExpirationSeconds).To(Equal(ptr.To(int64(DefaultTokenExpirationDefault.Seconds()))))
+		})
+	})
 	When("passed Pod has unparsed token expiration annotation", func() {
 		It("should raise error", func() {
 			idConfig := GCPWorkloadIdentityConfig{
@@ -50,7 +80,7 @@ var _ = Describe("GCPWorkloadIdentityMutator.mutatePod", func() {
 				},
 			}
 
-			err := m.mutatePod(pod, idConfig)
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
 			Expect(err).To(MatchError(ContainSubstring("must be positive integer string")))
 		})
 	})
@@ -62,6 +92,7 @@ var _ = Describe("GCPWorkloadIdentityMutator.mutatePod", func() {
 				Audience:                 ptr.To("my-audience"),
 				TokenExpirationSeconds:   ptr.To[int64](10000),
 				RunAsUser:                ptr.To[int64](1000),
+				InjectionMode:            GCloudMode,
 			}
 			pod := &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
@@ -118,8 +149,21 @@ var _ = Describe("GCPWorkloadIdentityMutator.mutatePod", func() {
 				},
 			}
 
-			err := m.mutatePod(pod, idConfig)
+			_, warnings, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
 			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ConsistOf(
+				`volume "gcp-iam-token" already exists with a different source; replaced by the webhook`,
+				`container "gcloud-setup" already exists with a different spec; replaced by the webhook`,
+				`volumeMount "gcp-iam-token" of container "ctr" differs from the injected one; replaced by the webhook`,
+				`volumeMount "gcp-iam-token" of container "ctr" differs from the injected one; replaced by the webhook`,
+				`env GOOGLE_APPLICATION_CREDENTIALS of container "ctr" is overridden by the webhook`,
+				`env GOOGLE_APPLICATION_CREDENTIALS of container "ctr" is overridden by the webhook`,
+			))
+
+			By("not warning again when the mutated Pod is mutated again")
+			_, warnings, err = m.mutatePod(pod.DeepCopy(), idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(BeEmpty())
 
 			expectedEnvVars := []corev1.EnvVar{
 				{
@@ -193,7 +237,7 @@ var _ = Describe("GCPWorkloadIdentityMutator.mutatePod", func() {
 				},
 			}
 
-			err := m.mutatePod(pod, idConfig)
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
 			Expect(err).NotTo(HaveOccurred())
 
 			expected := &corev1.Pod{
@@ -242,4 +286,315 @@ var _ = Describe("GCPWorkloadIdentityMutator.mutatePod", func() {
 			Expect(pod).To(BeEquivalentTo(expected))
 		})
 	})
+	When("image pull secrets for the gcloud image are configured", func() {
+		idConfig := GCPWorkloadIdentityConfig{
+			WorkloadIdentityProvider: &workloadIdentityProviderFmt,
+			ServiceAccountEmail:      ptr.To(fmt.Sprintf("sa@%s.iam.gserviceaccount.com", project)),
+		}
+		BeforeEach(func() {
+			m.GcloudImagePullSecrets = []corev1.LocalObjectReference{{Name: "gcloud-pull"}, {Name: "existing"}}
+		})
+		It("should append missing secrets when the gcloud-setup container is injected", func() {
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					ImagePullSecrets: []corev1.LocalObjectReference{{Name: "existing"}},
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+					}},
+				},
+			}
+
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Spec.ImagePullSecrets).To(BeEquivalentTo([]corev1.LocalObjectReference{
+				{Name: "existing"}, {Name: "gcloud-pull"},
+			}))
+		})
+		It("should not add image pull secrets when the bootstrap image replaces the gcloud image", func() {
+			m.BootstrapImage = "ghcr.io/pfnet-research/gcp-workload-identity-federation-webhook"
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+					}},
+				},
+			}
+
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Spec.ImagePullSecrets).To(BeEmpty())
+		})
+		It("should not touch image pull secrets in direct mode", func() {
+			idConfig := idConfig
+			idConfig.InjectionMode = DirectMode
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+					}},
+				},
+			}
+
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Spec.ImagePullSecrets).To(BeEmpty())
+		})
+	})
+	When("ServiceAccount is in metadata injection mode", func() {
+		idConfig := GCPWorkloadIdentityConfig{
+			WorkloadIdentityProvider: &workloadIdentityProviderFmt,
+			ServiceAccountEmail:      ptr.To(fmt.Sprintf("sa@%s.iam.gserviceaccount.com", project)),
+			InjectionMode:            MetadataMode,
+		}
+		It("should inject the metadata server sidecar and point containers to it", func() {
+			m.SidecarImage = "sidecar:test"
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+					}},
+				},
+			}
+
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Spec.InitContainers).To(BeEquivalentTo([]corev1.Container{
+				metadataServerContainer(*idConfig.WorkloadIdentityProvider, *idConfig.ServiceAccountEmail, project, "sidecar:test", nil, m.SetupContainerResources),
+			}))
+			Expect(pod.Spec.Containers).To(BeEquivalentTo([]corev1.Container{{
+				Name:  "ctr",
+				Image: "busybox",
+				Env: []corev1.EnvVar{
+					{Name: "GCE_METADATA_HOST", Value: MetadataServerAddress},
+					{Name: "GCE_METADATA_IP", Value: MetadataServerAddress},
+					cloudSDKComputeRegionEnvVar(m.DefaultGCloudRegion),
+					projectEnvVar(project),
+				},
+			}}))
+			Expect(pod.Spec.Volumes).To(BeEquivalentTo([]corev1.Volume{
+				k8sSATokenVolume(m.DefaultAudience, int64(m.DefaultTokenExpiration.Seconds()), defaultMode),
+			}))
+		})
+		It("should raise error when the metadata server image is not configured", func() {
+			pod := &corev1.Pod{}
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).To(MatchError(ContainSubstring("is not enabled")))
+		})
+	})
+	When("ServiceAccount is in access-token injection mode", func() {
+		It("should inject the access token refresher sidecar and the token file", func() {
+			idConfig := GCPWorkloadIdentityConfig{
+				WorkloadIdentityProvider: &workloadIdentityProviderFmt,
+				ServiceAccountEmail:      ptr.To(fmt.Sprintf("sa@%s.iam.gserviceaccount.com", project)),
+				InjectionMode:            AccessTokenMode,
+			}
+			m.SidecarImage = "sidecar:test"
+			m.AccessTokenRefresher = AccessTokenRefresherOptions{RefreshMargin: 10 * time.Minute}
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+					}},
+				},
+			}
+
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Spec.InitContainers).To(HaveLen(1))
+			Expect(pod.Spec.InitContainers[0].Name).To(Equal(AccessTokenRefresherName))
+			Expect(pod.Spec.InitContainers[0].RestartPolicy).To(HaveValue(Equal(corev1.ContainerRestartPolicyAlways)))
+			Expect(pod.Spec.InitContainers[0].Args).To(ContainElement("--refresh-margin=10m0s"))
+			Expect(pod.Spec.Containers).To(BeEquivalentTo([]corev1.Container{{
+				Name:         "ctr",
+				Image:        "busybox",
+				VolumeMounts: []corev1.VolumeMount{accessTokenVolumeMount},
+				Env: []corev1.EnvVar{
+					{Name: "CLOUDSDK_AUTH_ACCESS_TOKEN_FILE", Value: filepath.Join(AccessTokenMountPath, AccessTokenFilename)},
+					cloudSDKComputeRegionEnvVar(m.DefaultGCloudRegion),
+					projectEnvVar(project),
+				},
+			}}))
+			Expect(pod.Spec.Volumes).To(BeEquivalentTo([]corev1.Volume{
+				k8sSATokenVolume(m.DefaultAudience, int64(m.DefaultTokenExpiration.Seconds()), defaultMode),
+				accessTokenVolume,
+			}))
+		})
+	})
+	When("passed Pod has something suspicious", func() {
+		It("should warn about skip-containers naming non-existent containers and the empty project", func() {
+			idConfig := GCPWorkloadIdentityConfig{
+				WorkloadIdentityProvider: &workloadIdentityProviderFmt,
+				ServiceAccountEmail:      ptr.To("sa@example.com"),
+				InjectionMode:            GCloudMode,
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{
+						filepath.Join(annotaitonDomain, SkipContainersAnnotation): "ctr, typo",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+					}},
+				},
+			}
+
+			_, warnings, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ConsistOf(
+				ContainSubstring(`has container "typo" which does not exist`),
+				ContainSubstring(`could not derive the GCP project from "sa@example.com"`),
+			))
+		})
+	})
+	When("passed Pod mounts a different volume at the token path", func() {
+		var idConfig GCPWorkloadIdentityConfig
+		var pod *corev1.Pod
+		BeforeEach(func() {
+			idConfig = GCPWorkloadIdentityConfig{
+				WorkloadIdentityProvider: &workloadIdentityProviderFmt,
+				ServiceAccountEmail:      ptr.To(fmt.Sprintf("sa@%s.iam.gserviceaccount.com", project)),
+				InjectionMode:            GCloudMode,
+			}
+			pod = &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Volumes: []corev1.Volume{{
+						Name:         "user-token",
+						VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+					}},
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+						VolumeMounts: []corev1.VolumeMount{{
+							Name:      "user-token",
+							MountPath: K8sSATokenMountPath,
+						}},
+					}, {
+						Name:  "other",
+						Image: "busybox",
+					}},
+				},
+			}
+		})
+		It("should replace the mount by default", func() {
+			_, warnings, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ContainElement(ContainSubstring(`volumeMount "user-token" of container "ctr" is mounted at %s where volume "gcp-iam-token" is injected; replaced by the webhook`, K8sSATokenMountPath)))
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(Equal(volumeMountsToAddOrReplace(GCloudMode)))
+		})
+		It("should leave the container unmutated with skip-container policy", func() {
+			m.ConflictPolicy = ConflictPolicySkipContainer
+			_, warnings, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ContainElement(HavePrefix(`container "ctr" is not mutated: `)))
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(HaveLen(1))
+			Expect(pod.Spec.Containers[0].Env).To(BeEmpty())
+			Expect(pod.Spec.Containers[1].VolumeMounts).To(Equal(volumeMountsToAddOrReplace(GCloudMode)))
+		})
+		It("should raise error with reject policy", func() {
+			m.ConflictPolicy = ConflictPolicyReject
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).To(MatchError(ContainSubstring("conflict policy: reject")))
+		})
+		It("should raise error on volume collisions with skip-container policy", func() {
+			m.ConflictPolicy = ConflictPolicySkipContainer
+			pod.Spec.Volumes[0].Name = K8sSATokenVolumeName
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).To(MatchError(ContainSubstring(`volume "gcp-iam-token" already exists with a different source`)))
+		})
+		It("should raise error when a container has the name of the injected init container in any policy", func() {
+			pod.Spec.Containers[1].Name = GCloudSetupInitContainerName
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).To(MatchError(ContainSubstring(`container "gcloud-setup" collides with the injected init container`)))
+		})
+	})
+	When("ServiceAccount has additional identities", func() {
+		It("should project a token per audience and a credential configuration per identity", func() {
+			idConfig := GCPWorkloadIdentityConfig{
+				WorkloadIdentityProvider: &workloadIdentityProviderFmt,
+				ServiceAccountEmail:      ptr.To(fmt.Sprintf("sa@%s.iam.gserviceaccount.com", project)),
+				InjectionMode:            GCloudMode,
+				AdditionalIdentities: []AdditionalIdentity{{
+					Name:                     "org-a",
+					WorkloadIdentityProvider: workloadIdentityProviderFmt,
+					ServiceAccountEmail:      "sa@org-a.iam.gserviceaccount.com",
+				}, {
+					Name:                     "org-b",
+					WorkloadIdentityProvider: workloadIdentityProviderFmt,
+					ServiceAccountEmail:      "sa@org-b.iam.gserviceaccount.com",
+					Audience:                 ptr.To("org-b"),
+				}},
+			}
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+					}},
+				},
+			}
+
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+
+			expirationSeconds := int64(m.DefaultTokenExpiration.Seconds())
+			tokenVolume := k8sSATokenVolume(m.DefaultAudience, expirationSeconds, defaultMode)
+			tokenVolume.Projected.Sources = append(tokenVolume.Projected.Sources, corev1.VolumeProjection{
+				ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+					Audience:          "org-b",
+					ExpirationSeconds: &expirationSeconds,
+					Path:              "token-org-b",
+				},
+			})
+			Expect(pod.Spec.Volumes).To(BeEquivalentTo([]corev1.Volume{
+				tokenVolume,
+				gcloudConfigVolume,
+				m.identityCredentialsVolume(idConfig.AdditionalIdentities, defaultMode),
+			}))
+			Expect(pod.Spec.Volumes[2].DownwardAPI.Items).To(HaveLen(2))
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(Equal(append(volumeMountsToAddOrReplace(GCloudMode), identityCredentialsVolumeMount)))
+			Expect(pod.Spec.Containers[0].Env).To(ContainElement(corev1.EnvVar{
+				Name:  "GOOGLE_APPLICATION_CREDENTIALS",
+				Value: filepath.Join(GCloudConfigMountPath, ExternalCredConfigFilename),
+			}))
+
+			orgA, _ := buildExternalCredentialsJsonWithTokenFile(workloadIdentityProviderFmt, "sa@org-a.iam.gserviceaccount.com", K8sSATokenName)
+			orgB, _ := buildExternalCredentialsJsonWithTokenFile(workloadIdentityProviderFmt, "sa@org-b.iam.gserviceaccount.com", "token-org-b")
+			Expect(pod.Annotations).To(HaveKeyWithValue(externalConfigAnnotation+".org-a", orgA))
+			Expect(pod.Annotations).To(HaveKeyWithValue(externalConfigAnnotation+".org-b", orgB))
+			Expect(orgB).To(ContainSubstring(filepath.Join(K8sSATokenMountPath, "token-org-b")))
+		})
+		It("should mount the token in metadata mode too", func() {
+			m.SidecarImage = "sidecar:test"
+			idConfig := GCPWorkloadIdentityConfig{
+				WorkloadIdentityProvider: &workloadIdentityProviderFmt,
+				ServiceAccountEmail:      ptr.To(fmt.Sprintf("sa@%s.iam.gserviceaccount.com", project)),
+				InjectionMode:            MetadataMode,
+				AdditionalIdentities: []AdditionalIdentity{{
+					Name:                     "org-b",
+					WorkloadIdentityProvider: workloadIdentityProviderFmt,
+					ServiceAccountEmail:      "sa@org-b.iam.gserviceaccount.com",
+				}},
+			}
+			pod := &corev1.Pod{
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "ctr",
+						Image: "busybox",
+					}},
+				},
+			}
+
+			_, _, err := m.mutatePod(pod, idConfig, podSecurity{}, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pod.Spec.Containers[0].VolumeMounts).To(Equal([]corev1.VolumeMount{k8sSATokenVolumeMount, identityCredentialsVolumeMount}))
+		})
+	})
 })
@@ -2,14 +2,19 @@ package webhooks
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/go-logr/logr"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 
 	corev1 "k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/tools/cache"
 	ctrl "sigs.k8s.io/controller-runtime"
@@ -22,14 +27,42 @@ import (
 
 // GCPWorkloadIdentityMutator inject configurations for containers to acquire workload federated identity automatically
 type GCPWorkloadIdentityMutator struct {
-	AnnotationDomain        string
-	DefaultAudience         string
-	DefaultTokenExpiration  time.Duration
-	MinTokenExpration       time.Duration
-	DefaultGCloudRegion     string
-	GcloudImage             string
-	DefaultMode             int32
-	SetupContainerResources *corev1.ResourceRequirements
+	AnnotationDomain          string
+	DefaultAudience           string
+	DefaultTokenExpiration    time.Duration
+	MinTokenExpration         time.Duration
+	MaxTokenExpiration        time.Duration
+	PodOverridableAnnotations []string // token-expiration if nil
+	DefaultInjectionMode      InjectionMode
+	DeprecatedInjectionModes  []InjectionMode
+	DefaultGCloudRegion       string
+	GcloudImage               string
+	BootstrapImage            string
+	SidecarImage              string
+	AccessTokenRefresher      AccessTokenRefresherOptions
+	DefaultMode               int32
+	SetupContainerResources   *corev1.ResourceRequirements
+	GcloudImagePullSecrets    []corev1.LocalObjectReference
+	ConflictPolicy            ConflictPolicy
+	// SkipPodLabel is the label with which Pods opt out of the mutation by the value "true". Disabled if empty.
+	SkipPodLabel string
+	// ServiceAccountLookupTimeout bounds the lookup from the API server on cache miss
+	ServiceAccountLookupTimeout time.Duration
+	// RejectMissingServiceAccount rejects the Pods whose ServiceAccount is not found instead of admitting them as is
+	RejectMissingServiceAccount bool
+	// APIReader reads ServiceAccounts from the API server on cache miss. Defaults to the manager's one.
+	APIReader client.Reader
+	// ServiceAccountSelector and ServiceAccountNamespaces restrict the ServiceAccounts to inject the identities of.
+	// Pods using the other ServiceAccounts are not mutated.
+	ServiceAccountSelector   labels.Selector
+	ServiceAccountNamespaces []string
+	// NamespaceSelector restricts the namespaces by their labels. It requires the permission to watch Namespaces.
+	NamespaceSelector labels.Selector
+	// PodSecurityStandards shapes the injected container for the Pod Security Standards enforced in the namespace of
+	// the Pod by its labels. It requires the permission to watch Namespaces.
+	PodSecurityStandards bool
+	// AuditLogger records every decision of the webhook if set
+	AuditLogger *AuditLogger
 
 	logger  logr.Logger
 	decoder admission.Decoder
@@ -37,31 +70,66 @@ type GCPWorkloadIdentityMutator struct {
 }
 
 //+kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
+//+kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
 
 // Handle implements admission.Handler
 func (m *GCPWorkloadIdentityMutator) Handle(ctx context.Context, ar admission.Request) admission.Response {
+	ctx, span := tracer().Start(ctx, "Handle", trace.WithAttributes(admissionUIDKey.String(string(ar.UID)), attribute.String("k8s.namespace.name", ar.Namespace)))
+	defer span.End()
+
+	record := &AuditRecord{Time: time.Now(), UID: ar.UID, Namespace: ar.Namespace}
+	resp := m.handle(ctx, ar, record)
+	span.SetAttributes(attribute.Bool("admission.allowed", resp.Allowed), attribute.Int("admission.patches", len(resp.Patches)))
+	if !resp.Allowed && resp.Result != nil {
+		span.SetStatus(codes.Error, resp.Result.Message)
+	}
+	if m.AuditLogger != nil {
+		record.audit(resp)
+		if err := m.AuditLogger.Log(*record); err != nil {
+			m.logger.Error(err, "Failed to write the audit record", "uid", ar.UID)
+		}
+	}
+	return resp
+}
+
+func (m *GCPWorkloadIdentityMutator) handle(ctx context.Context, ar admission.Request, record *AuditRecord) admission.Response {
 	pod := &corev1.Pod{}
 	if err := m.decoder.Decode(ar, pod); err != nil {
 		return admission.Errored(http.StatusBadRequest, err)
 	}
 	logger := m.logger.WithValues("Pod", pod.Namespace+"/"+pod.Name)
+	record.PodName, record.PodGenerateName, record.ServiceAccount = pod.Name, pod.GenerateName, pod.Spec.ServiceAccountName
+
+	if m.SkipPodLabel != "" && pod.Labels[m.SkipPodLabel] == "true" {
+		logger.V(2).Info("Skip processing because the Pod opts out with the label", "label", m.SkipPodLabel)
+		return admission.Allowed("Skipped processing because the Pod opts out with the label " + m.SkipPodLabel)
+	}
 
 	if pod.Spec.ServiceAccountName == "" {
 		logger.V(2).Info("Skip processing because Spec.ServiceAccountName is empty (this might be a mirror pod)")
 		return admission.Allowed("Skipped processing because Spec.ServiceAccountName is empty (this might be a mirror pod)")
 	}
 
-	sa := corev1.ServiceAccount{}
-	err := m.Get(ctx, types.NamespacedName{Namespace: ar.Namespace, Name: pod.Spec.ServiceAccountName}, &sa)
+	sa, err := m.getServiceAccount(ctx, types.NamespacedName{Namespace: ar.Namespace, Name: pod.Spec.ServiceAccountName})
 	if err != nil && apierrors.IsNotFound(err) {
+		if m.RejectMissingServiceAccount {
+			logger.V(2).Info("Reject because ServiceAccount is not found", "ServiceAccount", pod.Spec.ServiceAccountName)
+			return admission.Denied(fmt.Sprintf("ServiceAccount %q is not found", pod.Spec.ServiceAccountName))
+		}
 		logger.V(2).Info("Skip processing because ServiceAccount is not found", "ServiceAccount", pod.Spec.ServiceAccountName)
 		return admission.Allowed("Skip processing because ServiceAccount is not found")
 	}
 	if err != nil {
 		return admission.Errored(http.StatusInternalServerError, err)
 	}
+	if sa == nil {
+		logger.V(2).Info("Skip processing because ServiceAccount is out of the scope", "ServiceAccount", pod.Spec.ServiceAccountName)
+		return admission.Allowed("Skip processing because ServiceAccount is out of the scope")
+	}
 
-	idConfig, err := NewGCPWorkloadIdentityConfig(m.AnnotationDomain, sa)
+	_, span := tracer().Start(ctx, "NewGCPWorkloadIdentityConfig")
+	idConfig, err := NewGCPWorkloadIdentityConfig(m.AnnotationDomain, corev1.ServiceAccount{ObjectMeta: sa.ObjectMeta})
+	endSpan(span, err)
 	if err != nil {
 		return admission.Errored(http.StatusBadRequest, err)
 	}
@@ -70,21 +138,28 @@ func (m *GCPWorkloadIdentityMutator) Handle(ctx context.Context, ar admission.Re
 		return admission.Allowed("")
 	}
 
-	if err := m.mutatePod(pod, *idConfig); err != nil {
-		return admission.Errored(http.StatusBadRequest, err)
+	podSecurity, err := m.getPodSecurity(ctx, ar.Namespace)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
 	}
 
-	marshaledPod, err := json.Marshal(pod)
+	_, span = tracer().Start(ctx, "mutatePod")
+	patches, warnings, err := m.mutatePod(pod, *idConfig, podSecurity, record)
+	endSpan(span, err)
 	if err != nil {
-		return admission.Errored(http.StatusInternalServerError, err)
+		return admission.Errored(http.StatusBadRequest, err)
 	}
-	return admission.PatchResponseFromRaw(ar.Object.Raw, marshaledPod)
+
+	resp := admission.Patched("", patches...)
+	resp.Warnings = warnings
+	injectionsTotal.WithLabelValues(record.InjectionMode, strconv.FormatBool(record.implicitInjectionMode)).Inc()
+	return resp
 }
 
 func (m *GCPWorkloadIdentityMutator) SetupWithManager(ctx context.Context, mgr ctrl.Manager) error {
 	logger := mgr.GetLogger().WithName("setup-gcp-wrokload-identity-mutator")
 
-	saInformer, err := mgr.GetCache().GetInformer(ctx, &corev1.ServiceAccount{})
+	saInformer, err := mgr.GetCache().GetInformer(ctx, serviceAccountMetadata())
 	if err != nil {
 		logger.Error(err, "Failed to get ServiceAccount informer")
 		return err
@@ -95,13 +170,24 @@ func (m *GCPWorkloadIdentityMutator) SetupWithManager(ctx context.Context, mgr c
 		return err
 	}
 
+	if m.NamespaceSelector != nil || m.PodSecurityStandards {
+		if _, err := mgr.GetCache().GetInformer(ctx, namespaceMetadata()); err != nil {
+			logger.Error(err, "Failed to get Namespace informer")
+			return err
+		}
+	}
+
 	// Inject logger, decoder, and client.
 	m.logger = mgr.GetLogger()
 	m.decoder = admission.NewDecoder(mgr.GetScheme())
 	m.Client = mgr.GetClient()
+	if m.APIReader == nil {
+		m.APIReader = mgr.GetAPIReader()
+	}
 
 	mgr.GetWebhookServer().Register("/mutate-v1-pod", &webhook.Admission{
-		Handler: m,
+		Handler:         m,
+		WithContextFunc: extractTraceContext,
 	})
 	return nil
 }
@@ -207,6 +207,40 @@ var _ = Describe("GCPWorkloadIdentityMutator", func() {
 				Expect(pod.Spec.Containers).To(BeEquivalentTo(expected.Spec.Containers))
 			})
 		})
+		When("Pod has the skip label", func() {
+			It("should mutate nothing", func() {
+				pod := &corev1.Pod{
+					ObjectMeta: metav1.ObjectMeta{
+						Namespace: namespace,
+						Name:      "test-pod",
+						Labels: map[string]string{
+							SkipPodLabelDefault: "true",
+						},
+					},
+					Spec: corev1.PodSpec{
+						ServiceAccountName: "default",
+						Containers: []corev1.Container{{
+							Name:  "ctr",
+							Image: "busybox:test",
+						}},
+					},
+				}
+				expected := &corev1.Pod{
+					ObjectMeta: pod.ObjectMeta,
+					Spec: corev1.PodSpec{
+						ServiceAccountName: "default",
+						Containers: []corev1.Container{
+							decorateDefault(pod.Spec.Containers[0]),
+						},
+					},
+				}
+
+				Expect(k8sClient.Create(ctx, pod)).NotTo(HaveOccurred())
+				Expect(pod.Annotations).NotTo(HaveKey(saEmailAnnotation))
+				Expect(pod.Spec.InitContainers).To(BeEmpty())
+				Expect(pod.Spec.Containers).To(BeEquivalentTo(expected.Spec.Containers))
+			})
+		})
 	})
 	Describe("Direct Injection Case", func() {
 		It("should inject external cred configurations via annotation & downwardAPI Volume", func() {
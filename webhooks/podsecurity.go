@@ -0,0 +1,104 @@
+package webhooks
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/pod-security-admission/api"
+	"k8s.io/pod-security-admission/policy"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// podSecurity is the levels and versions of the Pod Security Standards enforced and warned in the namespace of
+// the Pod. The zero value means no restriction.
+type podSecurity struct {
+	Enforce api.LevelVersion
+	Warn    api.LevelVersion
+}
+
+// podSecurityEvaluator runs the checks of Pod Security Admission
+var podSecurityEvaluator policy.Evaluator
+
+func init() {
+	var err error
+	podSecurityEvaluator, err = policy.NewEvaluator(policy.DefaultChecks(), nil)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// podSecurityFromLabels returns the levels and versions in the labels of the namespace, parsed by Pod Security
+// Admission, e.g. unknown enforced levels are treated as restricted.
+func podSecurityFromLabels(labels map[string]string) podSecurity {
+	privileged := api.LevelVersion{Level: api.LevelPrivileged, Version: api.LatestVersion()}
+	p, _ := api.PolicyToEvaluate(labels, api.Policy{Enforce: privileged, Audit: privileged, Warn: privileged})
+	return podSecurity{Enforce: p.Enforce, Warn: p.Warn}
+}
+
+// getPodSecurity reads the levels from the labels of the namespace if PodSecurityStandards is enabled
+func (m *GCPWorkloadIdentityMutator) getPodSecurity(ctx context.Context, namespace string) (podSecurity, error) {
+	if !m.PodSecurityStandards {
+		return podSecurity{}, nil
+	}
+	ns := namespaceMetadata()
+	_, span := tracer().Start(ctx, "GetNamespace")
+	err := m.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	endSpan(span, client.IgnoreNotFound(err))
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			// the cache may not have caught up with the namespace created just before the Pod
+			return podSecurity{}, nil
+		}
+		return podSecurity{}, err
+	}
+	return podSecurityFromLabels(ns.Labels), nil
+}
+
+// shapeInjectedContainer sets the securityContext of the container injected into the Pod in the namespace enforcing
+// the restricted level, unless the Pod sets them for all the containers, so that the injected one complies with it.
+// The injected containers always comply with the baseline level.
+func (ps podSecurity) shapeInjectedContainer(podSecurityContext *corev1.PodSecurityContext, ctr *corev1.Container) {
+	if ps.Enforce.Level != api.LevelRestricted {
+		return
+	}
+	if ctr.SecurityContext == nil {
+		ctr.SecurityContext = &corev1.SecurityContext{}
+	}
+	if podSecurityContext == nil || !ptr.Deref(podSecurityContext.RunAsNonRoot, false) {
+		ctr.SecurityContext.RunAsNonRoot = ptr.To(true)
+	}
+	if podSecurityContext == nil || !allowedSeccompProfile(podSecurityContext.SeccompProfile) {
+		ctr.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+	}
+}
+
+// podSecurityViolations returns the violations of the level and version by the container injected into the Pod as
+// an init container, evaluated by the checks of Pod Security Admission. The violations the Pod already has without it
+// are not returned, because they are not caused by the webhook.
+func podSecurityViolations(lv api.LevelVersion, pod *corev1.Pod, ctr corev1.Container) []string {
+	if lv.Level == "" || lv.Level == api.LevelPrivileged {
+		return nil
+	}
+	injected := pod.Spec.DeepCopy()
+	injected.InitContainers = append([]corev1.Container{ctr}, injected.InitContainers...)
+	before := podSecurityEvaluator.EvaluatePod(lv, &pod.ObjectMeta, &pod.Spec)
+	var violations []string
+	for i, result := range podSecurityEvaluator.EvaluatePod(lv, &pod.ObjectMeta, injected) {
+		if result.Allowed || !before[i].Allowed && before[i].ForbiddenDetail == result.ForbiddenDetail {
+			continue
+		}
+		violation := result.ForbiddenReason
+		if result.ForbiddenDetail != "" {
+			violation += " (" + result.ForbiddenDetail + ")"
+		}
+		violations = append(violations, violation)
+	}
+	return violations
+}
+
+func allowedSeccompProfile(profile *corev1.SeccompProfile) bool {
+	return profile != nil && (profile.Type == corev1.SeccompProfileTypeRuntimeDefault || profile.Type == corev1.SeccompProfileTypeLocalhost)
+}
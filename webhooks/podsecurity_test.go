@@ -0,0 +1,284 @@
+package webhooks
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/pod-security-admission/api"
+	"k8s.io/pod-security-admission/policy"
+	"k8s.io/utils/ptr"
+)
+
+// podSecurityVersions are the versions of the Pod Security Standards the injected containers are evaluated with
+var podSecurityVersions = []api.Version{
+	api.MajorMinorVersion(1, 0), api.MajorMinorVersion(1, 22), api.MajorMinorVersion(1, 25), api.LatestVersion(),
+}
+
+// evaluatePodSecurity returns the violations of the level and version by the Pod reported by Pod Security Admission
+func evaluatePodSecurity(lv api.LevelVersion, pod *corev1.Pod) string {
+	result := policy.AggregateCheckResults(podSecurityEvaluator.EvaluatePod(lv, &pod.ObjectMeta, &pod.Spec))
+	return result.ForbiddenDetail()
+}
+
+func TestPodSecurityFromLabels(t *testing.T) {
+	privileged := api.LevelVersion{Level: api.LevelPrivileged, Version: api.LatestVersion()}
+	tests := []struct {
+		name     string
+		labels   map[string]string
+		expected podSecurity
+	}{
+		{name: "no labels", expected: podSecurity{Enforce: privileged, Warn: privileged}},
+		{
+			name:   "levels",
+			labels: map[string]string{api.EnforceLevelLabel: "baseline", api.WarnLevelLabel: "restricted"},
+			expected: podSecurity{
+				Enforce: api.LevelVersion{Level: api.LevelBaseline, Version: api.LatestVersion()},
+				Warn:    api.LevelVersion{Level: api.LevelRestricted, Version: api.LatestVersion()},
+			},
+		},
+		{
+			name:   "versions",
+			labels: map[string]string{api.EnforceLevelLabel: "restricted", api.EnforceVersionLabel: "v1.24"},
+			expected: podSecurity{
+				Enforce: api.LevelVersion{Level: api.LevelRestricted, Version: api.MajorMinorVersion(1, 24)},
+				Warn:    api.LevelVersion{Level: api.LevelRestricted, Version: api.MajorMinorVersion(1, 24)},
+			},
+		},
+		{
+			name:   "unknown level",
+			labels: map[string]string{api.EnforceLevelLabel: "unknown"},
+			expected: podSecurity{
+				Enforce: api.LevelVersion{Level: api.LevelRestricted, Version: api.LatestVersion()},
+				Warn:    privileged,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if diff := cmp.Diff(tt.expected, podSecurityFromLabels(tt.labels), cmp.AllowUnexported(api.Version{})); diff != "" {
+				t.Errorf("podSecurityFromLabels() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestPodSecurity_shapeInjectedContainer(t *testing.T) {
+	const (
+		provider = "projects/123/locations/global/workloadIdentityPools/pool/providers/provider"
+		email    = "app@project.iam.gserviceaccount.com"
+		image    = "image"
+	)
+	containers := map[string]corev1.Container{
+		"gcloud":       gcloudSetupContainer(provider, email, "project", image, ptr.To[int64](1000), nil),
+		"bootstrap":    bootstrapSetupContainer(provider, email, "project", "region", image, nil, nil),
+		"metadata":     metadataServerContainer(provider, email, "project", image, nil, nil),
+		"access-token": accessTokenRefresherContainer(provider, email, image, AccessTokenRefresherOptions{}, nil, nil),
+	}
+	podSecurityContexts := map[string]*corev1.PodSecurityContext{
+		"none": nil,
+		"restricted": {
+			RunAsNonRoot:   ptr.To(true),
+			SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeLocalhost, LocalhostProfile: ptr.To("profile.json")},
+		},
+		"unconfined": {SeccompProfile: &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeUnconfined}},
+	}
+	restricted := podSecurity{Enforce: api.LevelVersion{Level: api.LevelRestricted, Version: api.LatestVersion()}}
+	for name, ctr := range containers {
+		for scName, sc := range podSecurityContexts {
+			t.Run(name+"/"+scName, func(t *testing.T) {
+				// the violations of the Pod with the container, unless the Pod has them without it
+				violations := func(lv api.LevelVersion, ctr corev1.Container) string {
+					pod := &corev1.Pod{Spec: corev1.PodSpec{SecurityContext: sc}}
+					without := evaluatePodSecurity(lv, pod)
+					pod.Spec.InitContainers = []corev1.Container{ctr}
+					if with := evaluatePodSecurity(lv, pod); with != without {
+						return with
+					}
+					return ""
+				}
+				for _, version := range podSecurityVersions {
+					if v := violations(api.LevelVersion{Level: api.LevelBaseline, Version: version}, ctr); v != "" {
+						t.Errorf("the unshaped container violates the baseline level %s: %s", version, v)
+					}
+				}
+				if v := violations(restricted.Enforce, ctr); scName != "restricted" && v == "" {
+					t.Errorf("the unshaped container complies with the restricted level")
+				}
+
+				shaped := *ctr.DeepCopy()
+				podSecurity{Enforce: api.LevelVersion{Level: api.LevelBaseline, Version: api.LatestVersion()}}.shapeInjectedContainer(sc, &shaped)
+				if diff := cmp.Diff(ctr, shaped); diff != "" {
+					t.Errorf("shapeInjectedContainer() changed the container for baseline (-want +got):\n%s", diff)
+				}
+
+				restricted.shapeInjectedContainer(sc, &shaped)
+				for _, version := range podSecurityVersions {
+					lv := api.LevelVersion{Level: api.LevelRestricted, Version: version}
+					if v := violations(lv, shaped); v != "" {
+						t.Errorf("the shaped container violates the restricted level %s: %s", version, v)
+					}
+					pod := &corev1.Pod{Spec: corev1.PodSpec{SecurityContext: sc}}
+					if v := podSecurityViolations(lv, pod, shaped); len(v) > 0 {
+						t.Errorf("podSecurityViolations() of the shaped container at %s: %v", version, v)
+					}
+					if v := podSecurityViolations(lv, pod, ctr); scName != "restricted" && len(v) == 0 {
+						t.Errorf("podSecurityViolations() of the unshaped container at %s returned no violations", version)
+					}
+				}
+				if scName == "restricted" {
+					if diff := cmp.Diff(ctr, shaped); diff != "" {
+						t.Errorf("shapeInjectedContainer() changed the container complying with the Pod (-want +got):\n%s", diff)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestPodSecurityViolations(t *testing.T) {
+	restricted := api.LevelVersion{Level: api.LevelRestricted, Version: api.LatestVersion()}
+	compliant := corev1.Container{Name: "injected", Image: "image", SecurityContext: &corev1.SecurityContext{
+		AllowPrivilegeEscalation: ptr.To(false),
+		Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+		RunAsNonRoot:             ptr.To(true),
+		SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+	}}
+	tests := []struct {
+		name     string
+		lv       api.LevelVersion
+		pod      corev1.PodSpec
+		ctr      corev1.Container
+		expected []string
+	}{
+		{name: "zero value", pod: corev1.PodSpec{HostNetwork: true}, ctr: corev1.Container{Name: "injected"}},
+		{name: "compliant", lv: restricted, ctr: compliant},
+		{
+			name: "violations of the Pod itself",
+			lv:   restricted,
+			pod:  corev1.PodSpec{HostNetwork: true, Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+			ctr:  compliant,
+		},
+		{
+			name: "root by the Pod",
+			lv:   restricted,
+			pod:  corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{RunAsUser: ptr.To[int64](0)}},
+			ctr:  compliant,
+		},
+		{
+			name: "root",
+			lv:   restricted,
+			pod:  corev1.PodSpec{SecurityContext: &corev1.PodSecurityContext{RunAsUser: ptr.To[int64](0)}},
+			ctr: func() corev1.Container {
+				ctr := *compliant.DeepCopy()
+				ctr.SecurityContext.RunAsUser = ptr.To[int64](0)
+				return ctr
+			}(),
+			expected: []string{
+				`runAsUser=0 (pod and container "injected" must not set runAsUser=0)`,
+			},
+		},
+		{
+			name: "privileged in baseline",
+			lv:   api.LevelVersion{Level: api.LevelBaseline, Version: api.MajorMinorVersion(1, 24)},
+			ctr:  corev1.Container{Name: "injected", Image: "image", SecurityContext: &corev1.SecurityContext{Privileged: ptr.To(true)}},
+			expected: []string{
+				`privileged (container "injected" must not set securityContext.privileged=true)`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{Spec: tt.pod}
+			if diff := cmp.Diff(tt.expected, podSecurityViolations(tt.lv, pod, tt.ctr)); diff != "" {
+				t.Errorf("podSecurityViolations() mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestGCPWorkloadIdentityMutator_mutatePod_podSecurity(t *testing.T) {
+	baseline := api.LevelVersion{Level: api.LevelBaseline, Version: api.LatestVersion()}
+	restricted := api.LevelVersion{Level: api.LevelRestricted, Version: api.LatestVersion()}
+	tests := []struct {
+		name         string
+		podSecurity  podSecurity
+		runAsUser    *int64
+		podRunAsUser *int64
+		warning      string
+		err          string
+	}{
+		{name: "privileged", podSecurity: podSecurity{}, runAsUser: ptr.To[int64](0)},
+		{
+			name:        "restricted",
+			podSecurity: podSecurity{Enforce: restricted},
+			runAsUser:   ptr.To[int64](1000),
+		},
+		{
+			name:        "restricted without runAsUser",
+			podSecurity: podSecurity{Enforce: restricted},
+			err:         `container "gcloud-setup" would run as root with the image ` + GcloudImageDefault,
+		},
+		{
+			name:         "restricted with runAsUser of the Pod",
+			podSecurity:  podSecurity{Enforce: restricted},
+			podRunAsUser: ptr.To[int64](1000),
+		},
+		{
+			name:        "restricted with root",
+			podSecurity: podSecurity{Enforce: restricted},
+			runAsUser:   ptr.To[int64](0),
+			err:         `container "gcloud-setup" must not set runAsUser=0`,
+		},
+		{
+			name:        "warn restricted",
+			podSecurity: podSecurity{Enforce: baseline, Warn: restricted},
+			runAsUser:   ptr.To[int64](1000),
+			warning:     `container "gcloud-setup" must set securityContext.runAsNonRoot=true`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idConfig := patchTestIdentity(GCloudMode)
+			idConfig.RunAsUser = tt.runAsUser
+			pod := &corev1.Pod{Spec: corev1.PodSpec{
+				ServiceAccountName: "app",
+				SecurityContext:    &corev1.PodSecurityContext{RunAsUser: tt.podRunAsUser},
+				Containers: []corev1.Container{{Name: "app", Image: "app", SecurityContext: &corev1.SecurityContext{
+					AllowPrivilegeEscalation: ptr.To(false),
+					Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
+					RunAsNonRoot:             ptr.To(true),
+					SeccompProfile:           &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault},
+				}}},
+			}}
+
+			_, warnings, err := newPatchTestMutator().mutatePod(pod, idConfig, tt.podSecurity, nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("mutatePod() error = %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("mutatePod() returned unexpected error: %v", err)
+			}
+			found := false
+			for _, w := range warnings {
+				found = found || tt.warning != "" && strings.Contains(w, tt.warning)
+			}
+			if tt.warning != "" && !found {
+				t.Errorf("mutatePod() warnings = %v, want %q", warnings, tt.warning)
+			}
+			for _, version := range podSecurityVersions {
+				lv := api.LevelVersion{Level: tt.podSecurity.Enforce.Level, Version: version}
+				if lv.Level == "" {
+					lv.Level = api.LevelBaseline
+				}
+				if violations := evaluatePodSecurity(lv, pod); violations != "" {
+					t.Errorf("the mutated Pod violates the enforced level %s: %s", lv, violations)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+const cacheSyncCheckTimeout = time.Second
+
+// CacheSyncWaiter is the part of cache.Cache which CacheSyncedChecker depends on
+type CacheSyncWaiter interface {
+	WaitForCacheSync(ctx context.Context) bool
+}
+
+// CacheSyncedChecker returns a healthz.Checker which is healthy after the informers of the cache, e.g. the one of
+// ServiceAccounts, have synced. Replicas must not receive admission requests before that because ServiceAccounts
+// missing from the cache have to be looked up from the API server.
+func CacheSyncedChecker(c CacheSyncWaiter) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), cacheSyncCheckTimeout)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("the cache is not synced yet")
+		}
+		return nil
+	}
+}
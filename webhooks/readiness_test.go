@@ -0,0 +1,28 @@
+package webhooks
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+type cacheSyncWaiterFunc func(ctx context.Context) bool
+
+func (f cacheSyncWaiterFunc) WaitForCacheSync(ctx context.Context) bool {
+	return f(ctx)
+}
+
+func TestCacheSyncedChecker(t *testing.T) {
+	synced := CacheSyncedChecker(cacheSyncWaiterFunc(func(context.Context) bool { return true }))
+	if err := synced(httptest.NewRequest("GET", "/readyz", nil)); err != nil {
+		t.Errorf("the checker of the synced cache returned unexpected error: %v", err)
+	}
+
+	notSynced := CacheSyncedChecker(cacheSyncWaiterFunc(func(ctx context.Context) bool {
+		<-ctx.Done()
+		return false
+	}))
+	if err := notSynced(httptest.NewRequest("GET", "/readyz", nil)); err == nil {
+		t.Error("the checker of the cache not synced must return an error")
+	}
+}
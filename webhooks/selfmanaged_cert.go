@@ -0,0 +1,343 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-logr/logr"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	SelfManagedCertValidityDefault      = 365 * 24 * time.Hour
+	SelfManagedCertCheckIntervalDefault = 10 * time.Minute
+
+	// the CA is valid for caValidityFactor times longer than the serving certificate
+	caValidityFactor = 10
+	// certificates are rotated when less than 1/rotationDivisor of their validity remains
+	rotationDivisor = 3
+	// retryInterval is the interval of the checks until the certificate is loaded for the first time
+	retryInterval = 10 * time.Second
+
+	caKeyKey = "ca.key"
+)
+
+// SelfManagedCert manages the serving certificate of the webhook without cert-manager. It generates a CA and
+// a serving certificate signed by it into a Secret, injects the CA into the caBundle of the
+// MutatingWebhookConfiguration, and rotates them before expiry. Every replica runs it, sharing the certificates
+// through the Secret, and serves the certificate by GetCertificate.
+//
+// The CA bundle keeps the previous CA after the CA rotation so that the kube-apiserver trusts both the replicas which
+// have loaded the new certificate and the ones which have not yet.
+//
+// It is optional and requires get/create/update on the Secret and get/update/patch on the
+// MutatingWebhookConfiguration, which the helm chart grants only with certificates.selfManaged.
+type SelfManagedCert struct {
+	// Secret is the Secret storing the CA and the serving certificate
+	Secret types.NamespacedName
+	// DNSNames of the serving certificate, i.e. the names of the webhook Service
+	DNSNames []string
+	// WebhookConfigurationName is the name of the MutatingWebhookConfiguration to inject the CA into
+	WebhookConfigurationName string
+	// Validity of the serving certificate. Defaults to SelfManagedCertValidityDefault.
+	Validity time.Duration
+	// CheckInterval is the interval to check the expiry and to reload the Secret possibly rotated by another replica.
+	// Defaults to SelfManagedCertCheckIntervalDefault.
+	CheckInterval time.Duration
+
+	// OnLoad is invoked with the serving certificate whenever it is (re)loaded, e.g. ServingCertificateObserver
+	OnLoad func(tls.Certificate)
+
+	// APIReader reads the Secret and the MutatingWebhookConfiguration without caching all of them in the cluster
+	APIReader client.Reader
+	client.Client
+
+	cert   atomic.Pointer[tls.Certificate]
+	logger logr.Logger
+}
+
+// GetCertificate is set to tls.Config of the webhook server
+func (c *SelfManagedCert) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := c.cert.Load()
+	if cert == nil {
+		return nil, errors.New("the serving certificate is not loaded yet")
+	}
+	return cert, nil
+}
+
+// NeedLeaderElection implements manager.LeaderElectionRunnable. Every replica needs to load the certificate.
+func (c *SelfManagedCert) NeedLeaderElection() bool {
+	return false
+}
+
+// Start implements manager.Runnable
+func (c *SelfManagedCert) Start(ctx context.Context) error {
+	for {
+		interval := c.checkInterval()
+		if err := c.reconcile(ctx, time.Now()); err != nil {
+			c.logger.Error(err, "Failed to reconcile the serving certificate", "Secret", c.Secret)
+			if c.cert.Load() == nil {
+				interval = retryInterval
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(interval):
+		}
+	}
+}
+
+func (c *SelfManagedCert) SetupWithManager(mgr ctrl.Manager) error {
+	c.logger = mgr.GetLogger().WithName("self-managed-cert")
+	if c.APIReader == nil {
+		c.APIReader = mgr.GetAPIReader()
+	}
+	if c.Client == nil {
+		c.Client = mgr.GetClient()
+	}
+	return mgr.Add(c)
+}
+
+func (c *SelfManagedCert) validity() time.Duration {
+	if c.Validity <= 0 {
+		return SelfManagedCertValidityDefault
+	}
+	return c.Validity
+}
+
+func (c *SelfManagedCert) checkInterval() time.Duration {
+	if c.CheckInterval <= 0 {
+		return SelfManagedCertCheckIntervalDefault
+	}
+	return c.CheckInterval
+}
+
+//+kubebuilder:rbac:groups="",resources=secrets,verbs=get;create;update
+//+kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations,verbs=get;update;patch
+
+// reconcile creates or rotates the certificates in the Secret, injects the CA bundle and loads the serving certificate
+func (c *SelfManagedCert) reconcile(ctx context.Context, now time.Time) error {
+	secret := &corev1.Secret{}
+	err := c.APIReader.Get(ctx, c.Secret, secret)
+	if apierrors.IsNotFound(err) {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: c.Secret.Namespace, Name: c.Secret.Name},
+			Type:       corev1.SecretTypeTLS,
+		}
+		if secret.Data, err = c.rotate(nil, now); err != nil {
+			return err
+		}
+		if err := c.Create(ctx, secret); err != nil {
+			// another replica may have created it at the same time, which is loaded at the next check
+			return fmt.Errorf("failed to create Secret %s: %w", c.Secret, err)
+		}
+		c.logger.Info("Generated the CA and the serving certificate", "Secret", c.Secret)
+	} else if err != nil {
+		return fmt.Errorf("failed to get Secret %s: %w", c.Secret, err)
+	} else if c.needsRotation(secret.Data, now) {
+		data, err := c.rotate(secret.Data, now)
+		if err != nil {
+			return err
+		}
+		secret.Data = data
+		if err := c.Update(ctx, secret); err != nil {
+			return fmt.Errorf("failed to update Secret %s: %w", c.Secret, err)
+		}
+		c.logger.Info("Rotated the serving certificate", "Secret", c.Secret)
+	}
+
+	if err := c.injectCABundle(ctx, secret.Data[corev1.ServiceAccountRootCAKey]); err != nil {
+		return err
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("failed to load the serving certificate in Secret %s: %w", c.Secret, err)
+	}
+	if previous := c.cert.Swap(&cert); c.OnLoad != nil && (previous == nil || !bytes.Equal(previous.Certificate[0], cert.Certificate[0])) {
+		c.OnLoad(cert)
+	}
+	return nil
+}
+
+// needsRotation reports whether the CA or the serving certificate in the Secret data is invalid or expires soon
+func (c *SelfManagedCert) needsRotation(data map[string][]byte, now time.Time) bool {
+	ca, _, err := parseCA(data)
+	if err != nil || expiresSoon(ca, now, c.validity()*caValidityFactor) {
+		return true
+	}
+	cert, err := parseCertificate(data[corev1.TLSCertKey])
+	if err != nil || expiresSoon(cert, now, c.validity()) {
+		return true
+	}
+	if _, err := tls.X509KeyPair(data[corev1.TLSCertKey], data[corev1.TLSPrivateKeyKey]); err != nil {
+		return true
+	}
+	return cert.CheckSignatureFrom(ca) != nil
+}
+
+// rotate returns the Secret data with the new serving certificate. The CA is reused unless it expires soon, and
+// the CA bundle contains the previous CA after the CA rotation.
+func (c *SelfManagedCert) rotate(data map[string][]byte, now time.Time) (map[string][]byte, error) {
+	ca, caKey, err := parseCA(data)
+	caBundle := data[corev1.ServiceAccountRootCAKey]
+	if err != nil || expiresSoon(ca, now, c.validity()*caValidityFactor) {
+		var previous []byte
+		if err == nil && now.Before(ca.NotAfter) {
+			previous = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		}
+		ca, caKey, err = generateCA(now, c.validity()*caValidityFactor)
+		if err != nil {
+			return nil, err
+		}
+		caBundle = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), previous...)
+	}
+
+	certPEM, keyPEM, err := generateServingCert(ca, caKey, c.DNSNames, now, c.validity())
+	if err != nil {
+		return nil, err
+	}
+	caKeyDER, err := x509.MarshalECPrivateKey(caKey)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		corev1.ServiceAccountRootCAKey: caBundle,
+		caKeyKey:                       pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: caKeyDER}),
+		corev1.TLSCertKey:              certPEM,
+		corev1.TLSPrivateKeyKey:        keyPEM,
+	}, nil
+}
+
+// injectCABundle sets the CA bundle to all webhooks of the MutatingWebhookConfiguration
+func (c *SelfManagedCert) injectCABundle(ctx context.Context, caBundle []byte) error {
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+	if err := c.APIReader.Get(ctx, types.NamespacedName{Name: c.WebhookConfigurationName}, config); err != nil {
+		return fmt.Errorf("failed to get MutatingWebhookConfiguration %s: %w", c.WebhookConfigurationName, err)
+	}
+	patch := client.MergeFrom(config.DeepCopy())
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			config.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if err := c.Patch(ctx, config, patch); err != nil {
+		return fmt.Errorf("failed to inject the CA bundle into MutatingWebhookConfiguration %s: %w", c.WebhookConfigurationName, err)
+	}
+	c.logger.Info("Injected the CA bundle", "MutatingWebhookConfiguration", c.WebhookConfigurationName)
+	return nil
+}
+
+// expiresSoon reports whether less than 1/rotationDivisor of the validity remains
+func expiresSoon(cert *x509.Certificate, now time.Time, validity time.Duration) bool {
+	return cert.NotAfter.Sub(now) < validity/rotationDivisor
+}
+
+// parseCA parses the CA signing the serving certificate, which is the first one in the CA bundle
+func parseCA(data map[string][]byte) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	ca, err := parseCertificate(data[corev1.ServiceAccountRootCAKey])
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data[caKeyKey])
+	if block == nil {
+		return nil, nil, errors.New("no CA key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("no certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func generateCA(now time.Time, validity time.Duration) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: fmt.Sprintf("gcp-workload-identity-federation-webhook-ca@%d", now.Unix())},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	ca, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ca, key, nil
+}
+
+func generateServingCert(ca *x509.Certificate, caKey *ecdsa.PrivateKey, dnsNames []string, now time.Time, validity time.Duration) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
@@ -0,0 +1,125 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestSelfManagedCert_reconcile(t *testing.T) {
+	ctx := context.Background()
+	const validity = 30 * 24 * time.Hour
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "gcp-wif-webhook-mutating-webhook-configuration"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mpod.kb.io"}, {Name: "mworkload.kb.io"}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(config).Build()
+	certs := &SelfManagedCert{
+		Secret:                   types.NamespacedName{Namespace: "gcp-wif-webhook-system", Name: "webhook-server-cert"},
+		DNSNames:                 []string{"gcp-wif-webhook-webhook-service.gcp-wif-webhook-system.svc"},
+		WebhookConfigurationName: config.Name,
+		Validity:                 validity,
+		APIReader:                c,
+		Client:                   c,
+	}
+
+	if _, err := certs.GetCertificate(nil); err == nil {
+		t.Error("GetCertificate() must fail before the certificate is loaded")
+	}
+
+	// verify checks the served certificate is trusted by the injected CA bundle and returns them
+	verify := func(t *testing.T, now time.Time) (*x509.Certificate, []byte) {
+		t.Helper()
+		if err := certs.reconcile(ctx, now); err != nil {
+			t.Fatalf("reconcile() returned unexpected error: %v", err)
+		}
+		actual := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		if err := c.Get(ctx, types.NamespacedName{Name: config.Name}, actual); err != nil {
+			t.Fatal(err)
+		}
+		caBundle := actual.Webhooks[0].ClientConfig.CABundle
+		if !bytes.Equal(caBundle, actual.Webhooks[1].ClientConfig.CABundle) {
+			t.Errorf("the CA bundle must be injected into all webhooks")
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(caBundle) {
+			t.Fatalf("the injected CA bundle is invalid: %s", caBundle)
+		}
+		tlsCert, err := certs.GetCertificate(nil)
+		if err != nil {
+			t.Fatalf("GetCertificate() returned unexpected error: %v", err)
+		}
+		cert, err := x509.ParseCertificate(tlsCert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cert.Verify(x509.VerifyOptions{DNSName: certs.DNSNames[0], Roots: roots, CurrentTime: now}); err != nil {
+			t.Errorf("the serving certificate is not trusted by the CA bundle: %v", err)
+		}
+		return cert, caBundle
+	}
+
+	now := time.Now()
+	cert, caBundle := verify(t, now)
+
+	t.Run("keeps the certificate before the rotation", func(t *testing.T) {
+		actual, actualCABundle := verify(t, now.Add(validity/2))
+		if !actual.Equal(cert) || !bytes.Equal(actualCABundle, caBundle) {
+			t.Error("the certificate must not be rotated")
+		}
+	})
+
+	t.Run("rotates the serving certificate with the same CA", func(t *testing.T) {
+		now = now.Add(validity * 3 / 4)
+		actual, actualCABundle := verify(t, now)
+		if actual.Equal(cert) {
+			t.Error("the serving certificate must be rotated")
+		}
+		if !bytes.Equal(actualCABundle, caBundle) {
+			t.Error("the CA must not be rotated")
+		}
+	})
+
+	t.Run("rotates the CA keeping the previous one in the bundle", func(t *testing.T) {
+		now = now.Add(validity * caValidityFactor * 3 / 4)
+		_, actualCABundle := verify(t, now)
+		if bytes.Equal(actualCABundle, caBundle) || !bytes.HasSuffix(actualCABundle, caBundle) {
+			t.Errorf("the CA bundle must have the new CA followed by the previous one: %s", actualCABundle)
+		}
+	})
+
+	t.Run("loads the Secret rotated by another replica", func(t *testing.T) {
+		other := &SelfManagedCert{
+			Secret:                   certs.Secret,
+			DNSNames:                 certs.DNSNames,
+			WebhookConfigurationName: certs.WebhookConfigurationName,
+			Validity:                 validity,
+			APIReader:                c,
+			Client:                   c,
+		}
+		if err := other.reconcile(ctx, now); err != nil {
+			t.Fatalf("reconcile() returned unexpected error: %v", err)
+		}
+		expected, _ := certs.GetCertificate(nil)
+		actual, _ := other.GetCertificate(nil)
+		if !bytes.Equal(expected.Certificate[0], actual.Certificate[0]) {
+			t.Error("the replicas must share the certificate")
+		}
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, certs.Secret, secret); err != nil {
+			t.Fatal(err)
+		}
+		if secret.Type != corev1.SecretTypeTLS {
+			t.Errorf("Secret type = %s, want %s", secret.Type, corev1.SecretTypeTLS)
+		}
+	})
+}
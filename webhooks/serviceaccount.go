@@ -0,0 +1,114 @@
+package webhooks
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const ServiceAccountLookupTimeoutDefault = 2 * time.Second
+
+// serviceAccountMetadata returns an empty PartialObjectMetadata of ServiceAccount. The webhook needs only
+// the annotations of ServiceAccounts, so they are cached as metadata to save memory.
+func serviceAccountMetadata() *metav1.PartialObjectMetadata {
+	sa := &metav1.PartialObjectMetadata{}
+	sa.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ServiceAccount"))
+	return sa
+}
+
+// namespaceMetadata returns an empty PartialObjectMetadata of Namespace, which is cached only with NamespaceSelector
+// or PodSecurityStandards
+func namespaceMetadata() *metav1.PartialObjectMetadata {
+	ns := &metav1.PartialObjectMetadata{}
+	ns.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("Namespace"))
+	return ns
+}
+
+// ServiceAccountCacheByObject returns the cache configuration of the ServiceAccounts for the manager, restricted by
+// the selector and namespaces if given. They must be the same as ServiceAccountSelector and ServiceAccountNamespaces
+// of GCPWorkloadIdentityMutator.
+func ServiceAccountCacheByObject(selector labels.Selector, namespaces []string) (client.Object, cache.ByObject) {
+	byObject := cache.ByObject{
+		Label:     selector,
+		Transform: cache.TransformStripManagedFields(),
+	}
+	if len(namespaces) > 0 {
+		byObject.Namespaces = map[string]cache.Config{}
+		for _, ns := range namespaces {
+			byObject.Namespaces[ns] = cache.Config{}
+		}
+	}
+	return serviceAccountMetadata(), byObject
+}
+
+// getServiceAccount reads the metadata of the ServiceAccount from the cache, and from the API server on cache miss
+// because the cache may not have caught up with the ServiceAccount created just before the Pod.
+// It returns nil without error when the ServiceAccount is out of ServiceAccountSelector, ServiceAccountNamespaces
+// or NamespaceSelector. With ServiceAccountSelector, a cache miss is taken as out of it without the lookup from the
+// API server, because the cache doesn't hold the ServiceAccounts out of it.
+func (m *GCPWorkloadIdentityMutator) getServiceAccount(ctx context.Context, key types.NamespacedName) (*metav1.PartialObjectMetadata, error) {
+	if len(m.ServiceAccountNamespaces) > 0 && !slices.Contains(m.ServiceAccountNamespaces, key.Namespace) {
+		return nil, nil
+	}
+	if m.NamespaceSelector != nil {
+		ns := namespaceMetadata()
+		_, span := tracer().Start(ctx, "GetNamespace")
+		err := m.Get(ctx, types.NamespacedName{Name: key.Namespace}, ns)
+		endSpan(span, client.IgnoreNotFound(err))
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		if !m.NamespaceSelector.Matches(labels.Set(ns.Labels)) {
+			return nil, nil
+		}
+	}
+
+	sa := serviceAccountMetadata()
+	_, span := tracer().Start(ctx, "GetServiceAccount", trace.WithAttributes(attribute.String("k8s.serviceaccount.name", key.Name)))
+	err := m.Get(ctx, key, sa)
+	endSpan(span, client.IgnoreNotFound(err))
+	if apierrors.IsNotFound(err) && m.ServiceAccountSelector != nil {
+		return nil, nil
+	}
+	if apierrors.IsNotFound(err) && m.APIReader != nil {
+		timeout := m.ServiceAccountLookupTimeout
+		if timeout <= 0 {
+			timeout = ServiceAccountLookupTimeoutDefault
+		}
+		lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		lookupCtx, span := tracer().Start(lookupCtx, "GetServiceAccountFromAPIServer", trace.WithAttributes(attribute.String("k8s.serviceaccount.name", key.Name)))
+		err = m.APIReader.Get(lookupCtx, key, sa)
+		endSpan(span, client.IgnoreNotFound(err))
+		switch {
+		case err == nil:
+			serviceAccountCacheMissesTotal.WithLabelValues("found").Inc()
+		case apierrors.IsNotFound(err):
+			serviceAccountCacheMissesTotal.WithLabelValues("not_found").Inc()
+		default:
+			serviceAccountCacheMissesTotal.WithLabelValues("error").Inc()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if m.ServiceAccountSelector != nil && !m.ServiceAccountSelector.Matches(labels.Set(sa.Labels)) {
+		return nil, nil
+	}
+	return sa, nil
+}
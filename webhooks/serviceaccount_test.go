@@ -0,0 +1,187 @@
+package webhooks
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/scheme"
+	toolscache "k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+func TestGCPWorkloadIdentityMutator_getServiceAccount(t *testing.T) {
+	key := types.NamespacedName{Namespace: "tenant-a", Name: "app"}
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: key.Namespace, Name: key.Name}}
+
+	t.Run("falls back to the API server on cache miss", func(t *testing.T) {
+		m := &GCPWorkloadIdentityMutator{
+			Client:    fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(),
+			APIReader: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sa.DeepCopy()).Build(),
+		}
+		before := testutil.ToFloat64(serviceAccountCacheMissesTotal.WithLabelValues("found"))
+
+		actual, err := m.getServiceAccount(context.Background(), key)
+		if err != nil {
+			t.Fatalf("getServiceAccount() returned unexpected error: %v", err)
+		}
+		if actual.Name != key.Name {
+			t.Errorf("getServiceAccount() = %v, want %v", actual.Name, key.Name)
+		}
+		if n := testutil.ToFloat64(serviceAccountCacheMissesTotal.WithLabelValues("found")) - before; n != 1 {
+			t.Errorf("cache misses with found = %v, want 1", n)
+		}
+	})
+
+	t.Run("does not call the API server on cache hit", func(t *testing.T) {
+		m := &GCPWorkloadIdentityMutator{
+			Client:    fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sa.DeepCopy()).Build(),
+			APIReader: fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(),
+		}
+		if _, err := m.getServiceAccount(context.Background(), key); err != nil {
+			t.Fatalf("getServiceAccount() returned unexpected error: %v", err)
+		}
+	})
+
+	t.Run("returns not found when the ServiceAccount truly does not exist", func(t *testing.T) {
+		m := &GCPWorkloadIdentityMutator{
+			Client:    fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(),
+			APIReader: fake.NewClientBuilder().WithScheme(scheme.Scheme).Build(),
+		}
+		before := testutil.ToFloat64(serviceAccountCacheMissesTotal.WithLabelValues("not_found"))
+
+		if _, err := m.getServiceAccount(context.Background(), key); !apierrors.IsNotFound(err) {
+			t.Errorf("getServiceAccount() = %v, want not found", err)
+		}
+		if n := testutil.ToFloat64(serviceAccountCacheMissesTotal.WithLabelValues("not_found")) - before; n != 1 {
+			t.Errorf("cache misses with not_found = %v, want 1", n)
+		}
+	})
+}
+
+func TestGCPWorkloadIdentityMutator_getServiceAccount_scope(t *testing.T) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-a", Name: "app", Labels: map[string]string{"team": "a"}}}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant-a", Labels: map[string]string{"tenant": "a"}}}
+	key := types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name}
+
+	for name, tc := range map[string]struct {
+		selector          labels.Selector
+		namespaces        []string
+		namespaceSelector labels.Selector
+		inScope           bool
+	}{
+		"no restriction":         {inScope: true},
+		"matching selector":      {selector: labels.SelectorFromSet(labels.Set{"team": "a"}), inScope: true},
+		"not matching selector":  {selector: labels.SelectorFromSet(labels.Set{"team": "b"})},
+		"listed namespace":       {namespaces: []string{"tenant-a"}, inScope: true},
+		"not listed namespace":   {namespaces: []string{"tenant-b"}},
+		"listed with a selector": {selector: labels.Everything(), namespaces: []string{"tenant-a"}, inScope: true},
+		"matching namespace":     {namespaceSelector: labels.SelectorFromSet(labels.Set{"tenant": "a"}), inScope: true},
+		"not matching namespace": {namespaceSelector: labels.SelectorFromSet(labels.Set{"tenant": "b"})},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// the cache holds only the ServiceAccounts in the scope as ServiceAccountCacheByObject configures
+			cached := []client.Object{ns.DeepCopy()}
+			if tc.inScope {
+				cached = append(cached, sa.DeepCopy())
+			}
+			readerCalls := 0
+			m := &GCPWorkloadIdentityMutator{
+				Client: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(cached...).Build(),
+				APIReader: fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sa.DeepCopy()).WithInterceptorFuncs(interceptor.Funcs{
+					Get: func(ctx context.Context, c client.WithWatch, key client.ObjectKey, obj client.Object, opts ...client.GetOption) error {
+						readerCalls++
+						return c.Get(ctx, key, obj, opts...)
+					},
+				}).Build(),
+				ServiceAccountSelector:   tc.selector,
+				ServiceAccountNamespaces: tc.namespaces,
+				NamespaceSelector:        tc.namespaceSelector,
+			}
+			actual, err := m.getServiceAccount(context.Background(), key)
+			if err != nil {
+				t.Fatalf("getServiceAccount() returned unexpected error: %v", err)
+			}
+			if (actual != nil) != tc.inScope {
+				t.Errorf("getServiceAccount() = %v, want in scope = %v", actual, tc.inScope)
+			}
+			if readerCalls > 0 {
+				t.Errorf("getServiceAccount() read the API server %d times", readerCalls)
+			}
+		})
+	}
+}
+
+// BenchmarkServiceAccountCache compares the heap retained by the ServiceAccount cache with the full objects and
+// with the metadata only objects stripped of managedFields, i.e. what ServiceAccountCacheByObject configures.
+func BenchmarkServiceAccountCache(b *testing.B) {
+	const numServiceAccounts = 10000
+	sas := make([]*corev1.ServiceAccount, numServiceAccounts)
+	for i := range sas {
+		sas[i] = &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: fmt.Sprintf("tenant-%d", i%100),
+				Name:      fmt.Sprintf("app-%d", i),
+				UID:       types.UID(fmt.Sprintf("00000000-0000-0000-0000-%012d", i)),
+				Labels:    map[string]string{"app.kubernetes.io/name": "app", "app.kubernetes.io/instance": fmt.Sprintf("app-%d", i)},
+				Annotations: map[string]string{
+					idProviderAnnotation: workloadIdentityProviderFmt,
+					saEmailAnnotation:    fmt.Sprintf("app-%d@project.iam.gserviceaccount.com", i),
+				},
+				ManagedFields: []metav1.ManagedFieldsEntry{{
+					Manager:    "helm",
+					Operation:  metav1.ManagedFieldsOperationUpdate,
+					APIVersion: "v1",
+					FieldsType: "FieldsV1",
+					FieldsV1:   &metav1.FieldsV1{Raw: []byte(`{"f:metadata":{"f:annotations":{".":{},"f:cloud.google.com/service-account-email":{},"f:cloud.google.com/workload-identity-provider":{}},"f:labels":{".":{},"f:app.kubernetes.io/instance":{},"f:app.kubernetes.io/name":{}}}}`)},
+				}},
+			},
+			Secrets:          []corev1.ObjectReference{{Name: fmt.Sprintf("app-%d-token", i)}},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "registry"}, {Name: "mirror"}},
+		}
+	}
+	_, byObject := ServiceAccountCacheByObject(nil, nil)
+
+	retained := func(b *testing.B, toCached func(*corev1.ServiceAccount) any) {
+		b.ReportAllocs()
+		var perObject float64
+		for b.Loop() {
+			store := toolscache.NewStore(toolscache.MetaNamespaceKeyFunc)
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			for _, sa := range sas {
+				if err := store.Add(toCached(sa.DeepCopy())); err != nil {
+					b.Fatal(err)
+				}
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			perObject = float64(after.HeapAlloc-before.HeapAlloc) / numServiceAccounts
+			runtime.KeepAlive(store)
+		}
+		b.ReportMetric(perObject, "retained-B/serviceaccount")
+	}
+
+	b.Run("full", func(b *testing.B) {
+		retained(b, func(sa *corev1.ServiceAccount) any { return sa })
+	})
+	b.Run("metadata", func(b *testing.B) {
+		retained(b, func(sa *corev1.ServiceAccount) any {
+			obj, err := byObject.Transform(&metav1.PartialObjectMetadata{TypeMeta: sa.TypeMeta, ObjectMeta: sa.ObjectMeta})
+			if err != nil {
+				b.Fatal(err)
+			}
+			return obj
+		})
+	})
+}
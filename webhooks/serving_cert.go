@@ -0,0 +1,30 @@
+package webhooks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// ServingCertificateObserver returns the callback invoked with the serving certificate whenever it is (re)loaded,
+// which logs and exports the expiry of the certificate so that it can be alerted before it lapses
+func ServingCertificateObserver(logger logr.Logger) func(tls.Certificate) {
+	return func(cert tls.Certificate) {
+		leaf := cert.Leaf
+		if leaf == nil && len(cert.Certificate) > 0 {
+			parsed, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				logger.Error(err, "Failed to parse the serving certificate")
+				return
+			}
+			leaf = parsed
+		}
+		if leaf == nil {
+			return
+		}
+		servingCertificateExpirationTimestamp.Set(float64(leaf.NotAfter.Unix()))
+		logger.Info("Loaded the serving certificate", "subject", leaf.Subject.String(), "notAfter", leaf.NotAfter.Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,31 @@
+package webhooks
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestServingCertificateObserver(t *testing.T) {
+	now := time.Now()
+	ca, caKey, err := generateCA(now, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := generateServingCert(ca, caKey, []string{"webhook-service.webhook-system.svc"}, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ServingCertificateObserver(logr.Discard())(cert)
+	if actual, want := testutil.ToFloat64(servingCertificateExpirationTimestamp), float64(now.Add(time.Hour).Unix()); actual != want {
+		t.Errorf("serving_certificate_expiration_timestamp_seconds = %v, want %v", actual, want)
+	}
+}
@@ -0,0 +1,193 @@
+package webhooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+	STSRequestTimeoutDefault = 30 * time.Second
+
+	stsGrantType          = "urn:ietf:params:oauth:grant-type:token-exchange"
+	stsRequestedTokenType = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+// AccessToken is an OAuth2 access token for GCP APIs
+type AccessToken struct {
+	Token  string
+	Expiry time.Time
+}
+
+// ExternalAccountTokenSource acquires access tokens as described by ExternalAccountCredentials, i.e. it exchanges
+// the Kubernetes ServiceAccount token at the STS endpoint and, if ServiceAccountImpersonationURL is set,
+// impersonates the GCP service account with generateAccessToken.
+type ExternalAccountTokenSource struct {
+	Credentials *ExternalAccountCredentials
+	Scopes      []string
+	HTTPClient  *http.Client
+	// RequestTimeout bounds each request to the endpoints so that a stalled one doesn't block the refresh forever.
+	// STSRequestTimeoutDefault if zero.
+	RequestTimeout time.Duration
+}
+
+type stsTokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int64  `json:"expires_in"`
+}
+
+type generateAccessTokenRequest struct {
+	Scope    []string `json:"scope"`
+	Lifetime string   `json:"lifetime,omitempty"`
+}
+
+type generateAccessTokenResponse struct {
+	AccessToken string    `json:"accessToken"`
+	ExpireTime  time.Time `json:"expireTime"`
+}
+
+// Token acquires a new access token. It does not cache tokens, see CachingTokenSource.
+func (s *ExternalAccountTokenSource) Token(ctx context.Context) (*AccessToken, error) {
+	subjectToken, err := os.ReadFile(s.Credentials.CredentialSource.File)
+	if err != nil {
+		return nil, fmt.Errorf("could not read subject token: %w", err)
+	}
+
+	stsToken, err := s.exchange(ctx, strings.TrimSpace(string(subjectToken)))
+	if err != nil {
+		return nil, err
+	}
+	if s.Credentials.ServiceAccountImpersonationURL == "" {
+		return stsToken, nil
+	}
+	return s.impersonate(ctx, stsToken.Token)
+}
+
+func (s *ExternalAccountTokenSource) exchange(ctx context.Context, subjectToken string) (*AccessToken, error) {
+	form := url.Values{
+		"grant_type":           {stsGrantType},
+		"audience":             {s.Credentials.Audience},
+		"scope":                {strings.Join(s.scopes(), " ")},
+		"requested_token_type": {stsRequestedTokenType},
+		"subject_token":        {subjectToken},
+		"subject_token_type":   {s.Credentials.SubjectTokenType},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Credentials.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp := stsTokenResponse{}
+	if err := s.do(req, &resp); err != nil {
+		return nil, fmt.Errorf("token exchange failed: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return nil, fmt.Errorf("token exchange failed: empty access_token in the response")
+	}
+	return &AccessToken{
+		Token:  resp.AccessToken,
+		Expiry: time.Now().Add(time.Duration(resp.ExpiresIn) * time.Second),
+	}, nil
+}
+
+func (s *ExternalAccountTokenSource) impersonate(ctx context.Context, stsToken string) (*AccessToken, error) {
+	body := generateAccessTokenRequest{Scope: s.scopes()}
+	if s.Credentials.ServiceAccountImpersonationLifetimeSeconds > 0 {
+		body.Lifetime = fmt.Sprintf("%ds", s.Credentials.ServiceAccountImpersonationLifetimeSeconds)
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.Credentials.ServiceAccountImpersonationURL, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+stsToken)
+
+	resp := generateAccessTokenResponse{}
+	if err := s.do(req, &resp); err != nil {
+		return nil, fmt.Errorf("service account impersonation failed: %w", err)
+	}
+	if resp.AccessToken == "" {
+		return nil, fmt.Errorf("service account impersonation failed: empty accessToken in the response")
+	}
+	return &AccessToken{Token: resp.AccessToken, Expiry: resp.ExpireTime}, nil
+}
+
+func (s *ExternalAccountTokenSource) do(req *http.Request, v any) error {
+	c := s.HTTPClient
+	if c == nil {
+		c = http.DefaultClient
+	}
+	timeout := s.RequestTimeout
+	if timeout <= 0 {
+		timeout = STSRequestTimeoutDefault
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	resp, err := c.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %d: %s", resp.StatusCode, string(b))
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (s *ExternalAccountTokenSource) scopes() []string {
+	if len(s.Scopes) == 0 {
+		return []string{CloudPlatformScope}
+	}
+	return s.Scopes
+}
+
+// TokenSource returns access tokens
+type TokenSource interface {
+	Token(ctx context.Context) (*AccessToken, error)
+}
+
+// CachingTokenSource caches the token of the underlying TokenSource until RefreshMargin before its expiry.
+type CachingTokenSource struct {
+	Source        TokenSource
+	RefreshMargin time.Duration
+
+	mu    sync.Mutex
+	token *AccessToken
+}
+
+func (c *CachingTokenSource) Token(ctx context.Context) (*AccessToken, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != nil && time.Now().Add(c.RefreshMargin).Before(c.token.Expiry) {
+		return c.token, nil
+	}
+	t, err := c.Source.Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.token = t
+	return t, nil
+}
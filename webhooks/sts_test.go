@@ -0,0 +1,175 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSTS is a stand-in of sts.googleapis.com and iamcredentials.googleapis.com
+type fakeSTS struct {
+	*httptest.Server
+	subjectToken string
+	exchanges    atomic.Int32
+	impersonates atomic.Int32
+	// failures makes the first N requests fail with 500
+	failures atomic.Int32
+}
+
+func newFakeSTS(t *testing.T, subjectToken string) *fakeSTS {
+	f := &fakeSTS{subjectToken: subjectToken}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/token", func(w http.ResponseWriter, r *http.Request) {
+		if f.failures.Add(-1) >= 0 {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		f.exchanges.Add(1)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.PostForm.Get("grant_type") != stsGrantType || r.PostForm.Get("subject_token") != f.subjectToken {
+			http.Error(w, "invalid_grant", http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(stsTokenResponse{
+			AccessToken:     "federated-token",
+			IssuedTokenType: stsRequestedTokenType,
+			TokenType:       "Bearer",
+			ExpiresIn:       3600,
+		})
+	})
+	mux.HandleFunc("/v1/projects/-/serviceAccounts/", func(w http.ResponseWriter, r *http.Request) {
+		f.impersonates.Add(1)
+		if r.Header.Get("Authorization") != "Bearer federated-token" {
+			http.Error(w, "unauthenticated", http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(generateAccessTokenResponse{
+			AccessToken: "gsa-token",
+			ExpireTime:  time.Now().Add(time.Hour).UTC().Truncate(time.Second),
+		})
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// credentials returns ExternalAccountCredentials pointing to the fake STS with the subject token written in a file
+func (f *fakeSTS) credentials(t *testing.T, gsaEmail string) *ExternalAccountCredentials {
+	tokenFile := filepath.Join(t.TempDir(), K8sSATokenName)
+	if err := os.WriteFile(tokenFile, []byte(f.subjectToken+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	creds := NewExternalAccountCredentials("//iam.googleapis.com/projects/1/locations/global/workloadIdentityPools/p/providers/p", gsaEmail)
+	creds.TokenURL = f.URL + "/v1/token"
+	creds.ServiceAccountImpersonationURL = f.URL + "/v1/projects/-/serviceAccounts/" + gsaEmail + ":generateAccessToken"
+	creds.CredentialSource.File = tokenFile
+	return creds
+}
+
+func TestExternalAccountTokenSource_Token(t *testing.T) {
+	t.Run("exchanges and impersonates", func(t *testing.T) {
+		sts := newFakeSTS(t, "k8s-token")
+		s := &ExternalAccountTokenSource{Credentials: sts.credentials(t, "sa@project.iam.gserviceaccount.com")}
+
+		token, err := s.Token(context.Background())
+		if err != nil {
+			t.Fatalf("Token() returned unexpected error: %v", err)
+		}
+		if token.Token != "gsa-token" {
+			t.Errorf("Token() = %q, want %q", token.Token, "gsa-token")
+		}
+		if time.Until(token.Expiry) < 59*time.Minute {
+			t.Errorf("Token() expiry = %v, want about an hour later", token.Expiry)
+		}
+	})
+
+	t.Run("returns the federated token without impersonation url", func(t *testing.T) {
+		sts := newFakeSTS(t, "k8s-token")
+		creds := sts.credentials(t, "sa@project.iam.gserviceaccount.com")
+		creds.ServiceAccountImpersonationURL = ""
+		s := &ExternalAccountTokenSource{Credentials: creds}
+
+		token, err := s.Token(context.Background())
+		if err != nil {
+			t.Fatalf("Token() returned unexpected error: %v", err)
+		}
+		if token.Token != "federated-token" {
+			t.Errorf("Token() = %q, want %q", token.Token, "federated-token")
+		}
+		if sts.impersonates.Load() != 0 {
+			t.Errorf("impersonation should not be called")
+		}
+	})
+
+	t.Run("fails with an invalid subject token", func(t *testing.T) {
+		sts := newFakeSTS(t, "k8s-token")
+		creds := sts.credentials(t, "sa@project.iam.gserviceaccount.com")
+		sts.subjectToken = "another-token"
+		s := &ExternalAccountTokenSource{Credentials: creds}
+
+		if _, err := s.Token(context.Background()); err == nil {
+			t.Errorf("Token() should return error")
+		}
+	})
+
+	t.Run("times out on a stalled endpoint", func(t *testing.T) {
+		release := make(chan struct{})
+		stalled := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+		t.Cleanup(stalled.Close)
+		t.Cleanup(func() { close(release) })
+		sts := newFakeSTS(t, "k8s-token")
+		creds := sts.credentials(t, "sa@project.iam.gserviceaccount.com")
+		creds.TokenURL = stalled.URL + "/v1/token"
+		s := &ExternalAccountTokenSource{Credentials: creds, RequestTimeout: 100 * time.Millisecond}
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := s.Token(context.Background())
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Token() = %v, want deadline exceeded", err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Token() does not time out")
+		}
+	})
+}
+
+func TestCachingTokenSource_Token(t *testing.T) {
+	sts := newFakeSTS(t, "k8s-token")
+	s := &CachingTokenSource{
+		Source:        &ExternalAccountTokenSource{Credentials: sts.credentials(t, "sa@project.iam.gserviceaccount.com")},
+		RefreshMargin: 5 * time.Minute,
+	}
+	for range 3 {
+		if _, err := s.Token(context.Background()); err != nil {
+			t.Fatalf("Token() returned unexpected error: %v", err)
+		}
+	}
+	if n := sts.exchanges.Load(); n != 1 {
+		t.Errorf("token exchange called %d times, want 1", n)
+	}
+
+	s.RefreshMargin = 2 * time.Hour
+	if _, err := s.Token(context.Background()); err != nil {
+		t.Fatalf("Token() returned unexpected error: %v", err)
+	}
+	if n := sts.exchanges.Load(); n != 2 {
+		t.Errorf("token exchange called %d times, want 2", n)
+	}
+}
@@ -0,0 +1,80 @@
+package webhooks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName  = "github.com/pfnet-research/gcp-workload-identity-federation-webhook/webhooks"
+	serviceName = "gcp-workload-identity-federation-webhook"
+
+	// admissionUIDKey is the attribute of the AdmissionReview UID
+	admissionUIDKey = attribute.Key("admission.uid")
+)
+
+// tracer returns the tracer of the global TracerProvider, which is no-op unless SetupTracing is called
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// endSpan ends the span recording the error if any
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// extractTraceContext returns the context with the trace context propagated by the kube-apiserver in the request headers
+func extractTraceContext(ctx context.Context, r *http.Request) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(r.Header))
+}
+
+// TracingOptions configures the export of the spans of the admission handling
+type TracingOptions struct {
+	// Endpoint is the URL of the OTLP/HTTP endpoint, e.g. "http://otel-collector:4318". Tracing is disabled if empty.
+	Endpoint string
+	// SampleRatio is the fraction of the traces sampled unless the parent span is sampled or not
+	SampleRatio float64
+}
+
+// SetupTracing sets the global TracerProvider exporting the spans to the OTLP endpoint.
+// It returns the function to flush and shut down the provider.
+func SetupTracing(ctx context.Context, opts TracingOptions) (func(context.Context) error, error) {
+	if opts.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	if opts.SampleRatio < 0 || opts.SampleRatio > 1 {
+		return nil, fmt.Errorf("sample ratio %v is out of 0-1", opts.SampleRatio)
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(attribute.String("service.name", serviceName)))
+	if err != nil && !errors.Is(err, resource.ErrSchemaURLConflict) {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
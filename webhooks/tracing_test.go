@@ -0,0 +1,119 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestGCPWorkloadIdentityMutator_Handle_tracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-a", Name: "app", Annotations: map[string]string{
+			idProviderAnnotation:    workloadIdentityProviderFmt,
+			saEmailAnnotation:       "app@project.iam.gserviceaccount.com",
+			injectionModeAnnotation: string(DirectMode),
+		}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sa).Build()
+	m := &GCPWorkloadIdentityMutator{
+		AnnotationDomain:       annotaitonDomain,
+		DefaultAudience:        AudienceDefault,
+		DefaultTokenExpiration: DefaultTokenExpirationDefault,
+		MinTokenExpration:      MinTokenExprationDefault,
+		DefaultMode:            VolumeModeDefault,
+		Client:                 c,
+		decoder:                admission.NewDecoder(scheme.Scheme),
+	}
+	raw, err := json.Marshal(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "tenant-a", Name: "app"},
+		Spec:       corev1.PodSpec{ServiceAccountName: "app", Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := m.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+		UID:       "uid",
+		Namespace: "tenant-a",
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if !resp.Allowed {
+		t.Fatalf("Handle() is not allowed: %v", resp.Result)
+	}
+
+	spans := recorder.Ended()
+	var names []string
+	var root sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		names = append(names, span.Name())
+		if span.Name() == "Handle" {
+			root = span
+		}
+	}
+	want := []string{"GetServiceAccount", "NewGCPWorkloadIdentityConfig", "mutatePod", "Handle"}
+	if diff := cmp.Diff(want, names); diff != "" {
+		t.Fatalf("spans mismatch (-want +got):\n%s", diff)
+	}
+	for _, span := range spans {
+		if span != root && span.Parent().SpanID() != root.SpanContext().SpanID() {
+			t.Errorf("span %s is not a child of Handle", span.Name())
+		}
+	}
+	found := false
+	for _, attr := range root.Attributes() {
+		if attr.Key == admissionUIDKey && attr.Value.AsString() == "uid" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Handle span does not have the AdmissionReview UID: %v", root.Attributes())
+	}
+}
+
+func TestSetupTracing(t *testing.T) {
+	shutdown, err := SetupTracing(context.Background(), TracingOptions{})
+	if err != nil {
+		t.Fatalf("SetupTracing() returned unexpected error without endpoint: %v", err)
+	}
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown of the no-op tracing returned unexpected error: %v", err)
+	}
+
+	if _, err := SetupTracing(context.Background(), TracingOptions{Endpoint: "http://otel-collector:4318", SampleRatio: 2}); err == nil {
+		t.Error("SetupTracing() must fail with the sample ratio out of 0-1")
+	}
+}
+
+func TestExtractTraceContext(t *testing.T) {
+	prev := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() { otel.SetTextMapPropagator(prev) })
+
+	r := httptest.NewRequest(http.MethodPost, "/mutate-v1-pod", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	sc := trace.SpanContextFromContext(extractTraceContext(context.Background(), r))
+	if sc.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" || !sc.IsSampled() || !sc.IsRemote() {
+		t.Errorf("the trace context is not extracted from the headers: %+v", sc)
+	}
+}
@@ -84,14 +84,16 @@ var _ = BeforeSuite(func() {
 	Expect(err).NotTo(HaveOccurred())
 
 	err = (&GCPWorkloadIdentityMutator{
-		AnnotationDomain:        AnnotationDomainDefault,
-		DefaultAudience:         AudienceDefault,
-		DefaultTokenExpiration:  DefaultTokenExpirationDefault,
-		MinTokenExpration:       MinTokenExprationDefault,
-		DefaultGCloudRegion:     DefaultGCloudRegionDefault,
-		GcloudImage:             GcloudImageDefault,
-		DefaultMode:             VolumeModeDefault,
-		SetupContainerResources: setupContainerResources,
+		AnnotationDomain:          AnnotationDomainDefault,
+		DefaultAudience:           AudienceDefault,
+		DefaultTokenExpiration:    DefaultTokenExpirationDefault,
+		MinTokenExpration:         MinTokenExprationDefault,
+		PodOverridableAnnotations: []string{TokenExpirationAnnotation},
+		DefaultGCloudRegion:       DefaultGCloudRegionDefault,
+		GcloudImage:               GcloudImageDefault,
+		DefaultMode:               VolumeModeDefault,
+		SetupContainerResources:   setupContainerResources,
+		SkipPodLabel:              SkipPodLabelDefault,
 	}).SetupWithManager(ctx, k8sManager)
 	Expect(err).NotTo(HaveOccurred())
 
@@ -0,0 +1,140 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// podTemplatePaths are the paths of the pod templates in the workload kinds supported by WorkloadPreviewAnnotator
+var podTemplatePaths = map[string][]string{
+	"Deployment":  {"spec", "template"},
+	"StatefulSet": {"spec", "template"},
+	"DaemonSet":   {"spec", "template"},
+	"Job":         {"spec", "template"},
+	"CronJob":     {"spec", "jobTemplate", "spec", "template"},
+}
+
+// WorkloadPreviewAnnotator annotates workloads with the preview of the identity which GCPWorkloadIdentityMutator
+// will inject into their Pods. It never mutates the pod templates. It must be set up after the Mutator, whose client
+// it shares.
+type WorkloadPreviewAnnotator struct {
+	// Mutator provides the configurations to resolve the identity
+	Mutator *GCPWorkloadIdentityMutator
+
+	logger logr.Logger
+}
+
+// +kubebuilder:webhook:path=/mutate-workloads,mutating=true,failurePolicy=ignore,groups=apps;batch,resources=deployments;statefulsets;daemonsets;jobs;cronjobs,verbs=create;update,versions=v1,name=mworkload.kb.io,admissionReviewVersions=v1,sideEffects=None
+
+// Handle implements admission.Handler
+func (a *WorkloadPreviewAnnotator) Handle(ctx context.Context, ar admission.Request) admission.Response {
+	path, ok := podTemplatePaths[ar.Kind.Kind]
+	if !ok {
+		return admission.Allowed(fmt.Sprintf("Skip processing because %s is not supported", ar.Kind.Kind))
+	}
+	obj := &unstructured.Unstructured{}
+	if err := json.Unmarshal(ar.Object.Raw, &obj.Object); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	logger := a.logger.WithValues(ar.Kind.Kind, ar.Namespace+"/"+obj.GetName())
+
+	templateObj, found, err := unstructured.NestedMap(obj.Object, path...)
+	if err != nil || !found {
+		return admission.Allowed("Skip processing because the pod template is not found")
+	}
+	template := corev1.PodTemplateSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(templateObj, &template); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+
+	preview, warnings, err := a.preview(ctx, ar.Namespace, template)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+
+	patch := &podPatch{}
+	annotations := obj.GetAnnotations()
+	if len(annotations) == 0 && len(preview) > 0 {
+		annotations = map[string]string{}
+		patch.add("/metadata/annotations", map[string]string{})
+	}
+	for _, name := range []string{PreviewWorkloadIdentityProviderAnnotation, PreviewServiceAccountEmailAnnotation, PreviewInjectionModeAnnotation} {
+		key := filepath.Join(a.Mutator.AnnotationDomain, name)
+		if v, ok := preview[name]; ok {
+			patch.setAnnotation(annotations, key, v)
+		} else if _, ok := annotations[key]; ok {
+			patch.remove(pathOf("/metadata/annotations", key))
+		}
+	}
+	logger.V(2).Info("Annotated the preview", "preview", preview)
+
+	resp := admission.Patched("", patch.ops...)
+	resp.Warnings = warnings
+	return resp
+}
+
+// preview resolves the identity for the Pods created from the template in the same way as GCPWorkloadIdentityMutator.
+// It returns no preview when no identity will be injected.
+func (a *WorkloadPreviewAnnotator) preview(ctx context.Context, namespace string, template corev1.PodTemplateSpec) (map[string]string, admission.Warnings, error) {
+	pod := &corev1.Pod{ObjectMeta: template.ObjectMeta, Spec: template.Spec}
+	if a.Mutator.SkipPodLabel != "" && pod.Labels[a.Mutator.SkipPodLabel] == "true" {
+		// the Pods opt out of the mutation
+		return nil, nil, nil
+	}
+	if pod.Spec.ServiceAccountName == "" {
+		// the ServiceAccount admission plugin sets it to the Pods
+		pod.Spec.ServiceAccountName = "default"
+	}
+
+	sa, err := a.Mutator.getServiceAccount(ctx, types.NamespacedName{Namespace: namespace, Name: pod.Spec.ServiceAccountName})
+	if apierrors.IsNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if sa == nil {
+		return nil, nil, nil
+	}
+
+	idConfig, err := NewGCPWorkloadIdentityConfig(a.Mutator.AnnotationDomain, corev1.ServiceAccount{ObjectMeta: sa.ObjectMeta})
+	if err != nil {
+		return nil, admission.Warnings{fmt.Sprintf("Pods will fail to be mutated: %s", err)}, nil
+	}
+	if idConfig == nil {
+		return nil, nil, nil
+	}
+	resolved, warnings, err := idConfig.Resolve(a.Mutator.AnnotationDomain, pod, a.Mutator.podOverridableAnnotations(), a.Mutator.resolveDefaults())
+	if err != nil {
+		return nil, admission.Warnings{fmt.Sprintf("Pods will fail to be mutated: %s", err)}, nil
+	}
+
+	return map[string]string{
+		PreviewWorkloadIdentityProviderAnnotation: *resolved.WorkloadIdentityProvider,
+		PreviewServiceAccountEmailAnnotation:      *resolved.ServiceAccountEmail,
+		PreviewInjectionModeAnnotation:            string(resolved.InjectionMode),
+	}, warnings, nil
+}
+
+func (a *WorkloadPreviewAnnotator) SetupWithManager(mgr ctrl.Manager) error {
+	a.logger = mgr.GetLogger().WithName("workload-preview-annotator")
+
+	mgr.GetWebhookServer().Register("/mutate-workloads", &webhook.Admission{
+		Handler: a,
+	})
+	return nil
+}
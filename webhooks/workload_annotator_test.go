@@ -0,0 +1,153 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/google/go-cmp/cmp"
+	jsonpatchv2 "gomodules.xyz/jsonpatch/v2"
+	admissionv1 "k8s.io/api/admission/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestWorkloadPreviewAnnotator_Handle(t *testing.T) {
+	const namespace = "tenant-a"
+	sas := []*corev1.ServiceAccount{{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app", Annotations: map[string]string{
+			idProviderAnnotation:    workloadIdentityProviderFmt,
+			saEmailAnnotation:       "app@project.iam.gserviceaccount.com",
+			injectionModeAnnotation: string(DirectMode),
+		}},
+	}, {
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "default"},
+	}}
+	a := &WorkloadPreviewAnnotator{
+		Mutator: &GCPWorkloadIdentityMutator{
+			AnnotationDomain:          annotaitonDomain,
+			DefaultAudience:           AudienceDefault,
+			DefaultTokenExpiration:    DefaultTokenExpirationDefault,
+			MinTokenExpration:         MinTokenExprationDefault,
+			PodOverridableAnnotations: []string{InjectionModeAnnotation},
+			Client:                    fake.NewClientBuilder().WithScheme(scheme.Scheme).WithObjects(sas[0], sas[1]).Build(),
+		},
+	}
+
+	handle := func(t *testing.T, obj runtime.Object, kind string) (map[string]string, admission.Response) {
+		t.Helper()
+		raw, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp := a.Handle(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Kind: kind},
+			Namespace: namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+		}})
+		if !resp.Allowed {
+			t.Fatalf("Handle() is not allowed: %v", resp.Result)
+		}
+		patch, err := json.Marshal(resp.Patches)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patched, err := decoded.Apply(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := metav1.PartialObjectMetadata{}
+		if err := json.Unmarshal(patched, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result.Annotations, resp
+	}
+
+	t.Run("annotates a Deployment with the preview", func(t *testing.T) {
+		deploy := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app"},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{injectionModeAnnotation: string(GCloudMode)}},
+				Spec:       corev1.PodSpec{ServiceAccountName: "app"},
+			}},
+		}
+		annotations, resp := handle(t, deploy, "Deployment")
+		want := map[string]string{
+			annotaitonDomain + "/" + PreviewWorkloadIdentityProviderAnnotation: workloadIdentityProviderFmt,
+			annotaitonDomain + "/" + PreviewServiceAccountEmailAnnotation:      "app@project.iam.gserviceaccount.com",
+			annotaitonDomain + "/" + PreviewInjectionModeAnnotation:            string(GCloudMode),
+		}
+		if diff := cmp.Diff(want, annotations); diff != "" {
+			t.Errorf("annotations mismatch (-want +got):\n%s", diff)
+		}
+		for _, p := range resp.Patches {
+			if !strings.HasPrefix(p.Path, "/metadata/annotations") {
+				t.Errorf("the patch must touch only annotations: %v", p)
+			}
+		}
+
+		deploy.Annotations = annotations
+		if _, resp := handle(t, deploy, "Deployment"); len(resp.Patches) > 0 {
+			t.Errorf("Handle() returned the patch for the up-to-date preview: %v", resp.Patches)
+		}
+	})
+
+	t.Run("removes the preview of a pod template with the skip label", func(t *testing.T) {
+		a.Mutator.SkipPodLabel = SkipPodLabelDefault
+		defer func() { a.Mutator.SkipPodLabel = "" }()
+		deploy := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app", Annotations: map[string]string{
+				annotaitonDomain + "/" + PreviewInjectionModeAnnotation: string(DirectMode),
+			}},
+			Spec: appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{SkipPodLabelDefault: "true"}},
+				Spec:       corev1.PodSpec{ServiceAccountName: "app"},
+			}},
+		}
+		if annotations, _ := handle(t, deploy, "Deployment"); len(annotations) > 0 {
+			t.Errorf("Handle() left the preview of the pod template with the skip label: %v", annotations)
+		}
+	})
+
+	t.Run("annotates a workload with the skip label whose Pods are mutated", func(t *testing.T) {
+		a.Mutator.SkipPodLabel = SkipPodLabelDefault
+		defer func() { a.Mutator.SkipPodLabel = "" }()
+		deploy := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "app", Labels: map[string]string{SkipPodLabelDefault: "true"}},
+			Spec:       appsv1.DeploymentSpec{Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{ServiceAccountName: "app"}}},
+		}
+		if annotations, _ := handle(t, deploy, "Deployment"); len(annotations) == 0 {
+			t.Errorf("Handle() returned no preview for the workload whose Pods are mutated")
+		}
+	})
+
+	t.Run("removes the stale preview of a CronJob without identity", func(t *testing.T) {
+		cronJob := &batchv1.CronJob{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "batch", Annotations: map[string]string{
+				annotaitonDomain + "/" + PreviewInjectionModeAnnotation: string(DirectMode),
+				"keep": "me",
+			}},
+			Spec: batchv1.CronJobSpec{JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: corev1.PodTemplateSpec{}}}},
+		}
+		annotations, resp := handle(t, cronJob, "CronJob")
+		if diff := cmp.Diff(map[string]string{"keep": "me"}, annotations); diff != "" {
+			t.Errorf("annotations mismatch (-want +got):\n%s", diff)
+		}
+		want := []jsonpatchv2.Operation{{Operation: "remove", Path: "/metadata/annotations/" + strings.ReplaceAll(annotaitonDomain, "/", "~1") + "~1" + PreviewInjectionModeAnnotation}}
+		if diff := cmp.Diff(want, resp.Patches); diff != "" {
+			t.Errorf("patch mismatch (-want +got):\n%s", diff)
+		}
+	})
+}